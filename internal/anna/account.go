@@ -0,0 +1,131 @@
+package anna
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"go.uber.org/zap"
+)
+
+// FastDownloadError is an error answered by the fast download API, such as an
+// invalid secret key or an exhausted quota.
+type FastDownloadError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *FastDownloadError) Error() string {
+	return fmt.Sprintf("API error: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// GetAccountStatus returns the fast download quota of the account.
+//
+// The API only reports the quota along with a download URL, and asking for a
+// file may use up a download, so only a made up hash matching no file is
+// asked for. When the quota is not reported with it, the one saved by the
+// last fast download is returned.
+func GetAccountStatus(ctx context.Context) (*AccountStatus, error) {
+	l := logger.GetLogger()
+
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := env.RequireFastDownload(); err != nil {
+		return nil, err
+	}
+
+	client := newAPIClient(env.Timeouts)
+	saved := loadAccountStatus(env)
+
+	apiResp, mirror, err := withMirrors(ctx, env.AnnasBaseURLs, "account", func(baseURL string) (*fastDownloadResponse, error) {
+		return fetchFastDownload(ctx, client, baseURL, mirrorProbeHash, env.SecretKey)
+	})
+	if err == nil && apiResp.AccountInfo != nil {
+		status := newAccountStatus(apiResp.AccountInfo, mirror)
+		status.Live = true
+		saveAccountStatus(env, status)
+		return status, nil
+	}
+
+	// The made up hash is expected to be rejected as not found, which says
+	// nothing about the key or the quota. Other rejections, such as of an
+	// invalid key, are reported.
+	var apiErr *FastDownloadError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound) {
+		return nil, err
+	}
+
+	l.Info("Fast download quota not reported, using the saved one", zap.Bool("saved", saved != nil))
+
+	if saved == nil {
+		return &AccountStatus{Mirror: mirror}, nil
+	}
+	return saved, nil
+}
+
+func newAccountStatus(info *fastDownloadAccountInfo, mirror string) *AccountStatus {
+	return &AccountStatus{
+		Known:              true,
+		DownloadsLeft:      info.DownloadsLeft,
+		DownloadsPerDay:    info.DownloadsPerDay,
+		RecentlyDownloaded: info.RecentlyDownloadedMD5s,
+		CheckedAt:          time.Now().UTC(),
+		Mirror:             mirror,
+	}
+}
+
+// accountStatusPath returns where the quota reported by the last fast
+// download is kept, separately for every profile.
+func accountStatusPath(env *env.Env) (string, error) {
+	return env.StatePath("account", ".json")
+}
+
+// saveAccountStatus keeps the quota for later calls of GetAccountStatus.
+// Failing to do so only makes the status less accurate, so errors are logged.
+func saveAccountStatus(env *env.Env, status *AccountStatus) {
+	l := logger.GetLogger()
+
+	path, err := accountStatusPath(env)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		saved := *status
+		saved.Live = false
+		var data []byte
+		if data, err = json.Marshal(&saved); err == nil {
+			err = os.WriteFile(path, data, 0o600)
+		}
+	}
+	if err != nil {
+		l.Warn("Failed to save the fast download quota", zap.Error(err))
+	}
+}
+
+func loadAccountStatus(env *env.Env) *AccountStatus {
+	path, err := accountStatusPath(env)
+	if err != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var status AccountStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		logger.GetLogger().Warn("Ignoring unreadable saved fast download quota", zap.String("path", path), zap.Error(err))
+		return nil
+	}
+	return &status
+}
@@ -1,13 +1,16 @@
 package anna
 
 import (
+	"context"
+	"crypto/md5"
 	"fmt"
 	"net/url"
+	"strconv"
 
 	"strings"
 	"sync"
-	"time"
 
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -24,34 +27,79 @@ import (
 )
 
 const (
-	AnnasSearchEndpointFormat   = "https://%s/search?q=%s&content=%s"
+	AnnasSearchEndpointFormat   = "https://%s/search?%s"
 	AnnasSciDBEndpointFormat    = "https://%s/scidb/%s"
+	AnnasMD5EndpointFormat      = "https://%s/md5/%s"
 	AnnasDownloadEndpointFormat = "https://%s/dyn/api/fast_download.json?md5=%s&key=%s"
-	HTTPTimeout                 = 30 * time.Second
+	DefaultFilenameTemplate     = "{title}"
 	BrowserUserAgent            = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
 )
 
 var (
 	// Regex to sanitize filenames - removes dangerous characters
 	unsafeFilenameChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]`)
+
+	// Publication years appear as a standalone part of the meta line
+	yearRegex = regexp.MustCompile(`^(1[5-9]|20)\d{2}$`)
+
+	// Content types are prefixed by an emoji, e.g. "📘 Book (non-fiction)"
+	contentTypeRegex = regexp.MustCompile(`(?i)^\W*((?:book|journal article|comic book|magazine|musical score|standards document|other)\b.*)$`)
+
+	// Human readable sizes such as "0.7MB" or "1.2 GB"
+	sizeValueRegex = regexp.MustCompile(`(?i)(\d+(?:\.\d+)?)\s*(B|KB|MB|GB|TB)\b`)
+
+	// Placeholders of filename templates, such as "{title}"
+	filenamePlaceholderRegex = regexp.MustCompile(`\{\w+\}`)
+
+	// Books are addressed by the hex encoded MD5 of the file
+	md5HashRegex = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+	// ISBNs, either labelled in the page text or embedded in identifier codes
+	isbnRegex = regexp.MustCompile(`(?i)isbn(?:-?1[03])?[:\s]*((?:97[89][\s-]?)?(?:\d[\s-]?){9}[\dX])\b`)
+
+	// Editions are usually written as "2nd edition" or "3rd ed."
+	editionRegex = regexp.MustCompile(`(?i)\b(\d+(?:st|nd|rd|th)\s+(?:edition|ed\.?)|(?:first|second|third|fourth|fifth|revised|updated)\s+edition)`)
+
+	// Sort orders accepted by the search page, keyed by the names we expose.
+	// Most relevant is the site default and is requested by omitting the
+	// parameter.
+	searchSortOrders = map[string]string{
+		"":             "",
+		"relevant":     "",
+		"newest":       "newest",
+		"oldest":       "oldest",
+		"largest":      "largest",
+		"smallest":     "smallest",
+		"newest_added": "newest_added",
+		"oldest_added": "oldest_added",
+	}
 )
 
-func extractMetaInformation(meta string) (language, format, size string) {
+// ErrPaperNotFound is returned when Anna's Archive has no file for a DOI.
+var ErrPaperNotFound = errors.New("no paper found for DOI")
+
+// IsMD5 tells whether s is a hex encoded MD5, as books are addressed by.
+func IsMD5(s string) bool {
+	return md5HashRegex.MatchString(s)
+}
+
+func extractMetaInformation(meta string) metaInformation {
 	// The meta format may be:
 	// - "✅ English [en] · EPUB · 0.7MB · 2015 · ..."
 	// - "✅ English [en] · Hindi [hi] · EPUB · 0.7MB · ..."
+	var info metaInformation
 	parts := strings.Split(meta, " · ")
 	if len(parts) < 3 {
-		return "", "", ""
+		return info
 	}
 
 	// Extract language from first part
 	languagePart := strings.TrimSpace(parts[0])
 	if idx := strings.Index(languagePart, "["); idx > 0 {
-		language = strings.TrimSpace(languagePart[:idx])
+		language := strings.TrimSpace(languagePart[:idx])
 		// Remove checkmark and leading spaces properly
 		language = strings.TrimPrefix(language, "✅")
-		language = strings.TrimSpace(language)
+		info.Language = strings.TrimSpace(language)
 	}
 
 	// Common ebook formats (case-insensitive search)
@@ -65,25 +113,193 @@ func extractMetaInformation(meta string) (language, format, size string) {
 		part := strings.TrimSpace(parts[i])
 
 		// Check for size
-		if size == "" && sizeRegex.MatchString(part) {
-			size = part
+		if info.Size == "" && sizeRegex.MatchString(part) {
+			info.Size = part
+			info.SizeBytes = parseSize(part)
 		}
 
 		// Check for format
-		if format == "" && formatRegex.MatchString(part) {
+		if info.Format == "" && formatRegex.MatchString(part) {
 			matches := formatRegex.FindStringSubmatch(part)
 			if len(matches) > 0 {
-				format = strings.ToUpper(matches[1])
+				info.Format = strings.ToUpper(matches[1])
+			}
+		}
+
+		// Check for publication year
+		if info.Year == 0 && yearRegex.MatchString(part) {
+			info.Year, _ = strconv.Atoi(part)
+		}
+
+		// Check for content type, e.g. "📘 Book (non-fiction)"
+		if info.ContentType == "" {
+			if matches := contentTypeRegex.FindStringSubmatch(part); len(matches) > 1 {
+				info.ContentType = matches[1]
+			}
+		}
+	}
+
+	info.Collections = extractCollections(meta)
+
+	return info
+}
+
+// parseSize converts a human readable size into bytes. The site prints sizes
+// with decimal units and one decimal place, so the result is approximate.
+func parseSize(size string) int64 {
+	matches := sizeValueRegex.FindStringSubmatch(size)
+	if len(matches) < 3 {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0
+	}
+
+	multiplier := map[string]float64{
+		"B":  1,
+		"KB": 1e3,
+		"MB": 1e6,
+		"GB": 1e9,
+		"TB": 1e12,
+	}[strings.ToUpper(matches[2])]
+
+	return int64(value * multiplier)
+}
+
+// extractCollections returns the source collections listed in the meta line,
+// which appear as a single part such as "🚀/lgli/lgrs/zlib".
+func extractCollections(meta string) []string {
+	for _, part := range strings.Split(meta, " · ") {
+		part = strings.TrimSpace(part)
+		idx := strings.Index(part, "/")
+		if idx < 0 || strings.ContainsAny(part[:idx], " 0123456789") || strings.Contains(part[idx:], " ") {
+			continue
+		}
+		collections := make([]string, 0)
+		for _, collection := range strings.Split(part[idx+1:], "/") {
+			if collection = strings.TrimSpace(collection); collection != "" {
+				collections = append(collections, collection)
 			}
 		}
+		if len(collections) > 0 {
+			return collections
+		}
+	}
+	return nil
+}
+
+// normalizeISBN strips separators from an ISBN and returns an empty string if
+// the result does not have a valid ISBN length.
+func normalizeISBN(isbn string) string {
+	isbn = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+	if len(isbn) != 10 && len(isbn) != 13 {
+		return ""
+	}
+	return isbn
+}
 
-		// Early exit if we found both
-		if format != "" && size != "" {
-			break
+// appendUnique appends value to values unless it is empty or already present.
+func appendUnique(values []string, value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
 		}
 	}
+	return append(values, value)
+}
+
+// buildSearchURL maps the search options onto the query parameters understood
+// by the search page. Repeated filters (e.g. several languages) are sent as
+// repeated parameters, which the site combines with OR.
+func buildSearchURL(baseURL string, opts SearchOptions, content string, page int) (string, error) {
+	sort, ok := searchSortOrders[strings.ToLower(opts.Sort)]
+	if !ok {
+		return "", fmt.Errorf("unsupported sort order: %s", opts.Sort)
+	}
+
+	query := url.Values{}
+	query.Set("q", opts.Query)
+	query.Set("content", content)
+	for _, lang := range opts.Languages {
+		query.Add("lang", strings.ToLower(strings.TrimSpace(lang)))
+	}
+	for _, ext := range opts.Extensions {
+		query.Add("ext", strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")))
+	}
+	for _, src := range opts.Sources {
+		query.Add("src", strings.ToLower(strings.TrimSpace(src)))
+	}
+	if sort != "" {
+		query.Set("sort", sort)
+	}
+	query.Set("page", strconv.Itoa(page))
+
+	return fmt.Sprintf(AnnasSearchEndpointFormat, baseURL, query.Encode()), nil
+}
+
+// withDefaults fills in the filters left unset with the configured defaults.
+func (opts SearchOptions) withDefaults(defaults env.SearchDefaults) SearchOptions {
+	if opts.Content == "" {
+		opts.Content = defaults.Content
+	}
+	if len(opts.Languages) == 0 {
+		opts.Languages = defaults.Languages
+	}
+	if len(opts.Extensions) == 0 {
+		opts.Extensions = defaults.Extensions
+	}
+	if len(opts.Sources) == 0 {
+		opts.Sources = defaults.Sources
+	}
+	if opts.YearFrom == 0 {
+		opts.YearFrom = defaults.YearFrom
+	}
+	if opts.YearTo == 0 {
+		opts.YearTo = defaults.YearTo
+	}
+	if opts.Sort == "" {
+		opts.Sort = defaults.Sort
+	}
+	return opts
+}
+
+// inYearRange reports whether a book's year satisfies the requested range.
+// The search page has no year parameter, so the range is applied to the
+// parsed results; books without a known year are dropped once a range is set.
+func inYearRange(year int, opts SearchOptions) bool {
+	if opts.YearFrom == 0 && opts.YearTo == 0 {
+		return true
+	}
+	if year == 0 {
+		return false
+	}
+	if opts.YearFrom != 0 && year < opts.YearFrom {
+		return false
+	}
+	if opts.YearTo != 0 && year > opts.YearTo {
+		return false
+	}
+	return true
+}
+
+// expandFilenameTemplate replaces the {placeholders} of a template such as
+// "{authors} - {title}" with the given fields. Unknown or empty placeholders
+// expand to nothing, and the separators left around them are trimmed.
+func expandFilenameTemplate(template string, fields map[string]string) string {
+	if template == "" {
+		template = DefaultFilenameTemplate
+	}
 
-	return language, format, size
+	name := filenamePlaceholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return strings.TrimSpace(fields[strings.ToLower(strings.Trim(placeholder, "{}"))])
+	})
+	return strings.Trim(name, " -_.,")
 }
 
 // sanitizeFilename removes dangerous characters and prevents path traversal
@@ -103,10 +319,38 @@ func sanitizeFilename(filename string) string {
 	return safe
 }
 
-func FindBook(query string, content string) ([]*Book, error) {
+func FindBook(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = opts.withDefaults(env.SearchDefaults)
+	content := opts.Content
 	if content == "" {
 		content = "book_any"
 	}
+	page := opts.Page
+	if page < 1 {
+		page = 1
+	}
+	if opts.YearFrom != 0 && opts.YearTo != 0 && opts.YearFrom > opts.YearTo {
+		return nil, fmt.Errorf("invalid year range: %d is after %d", opts.YearFrom, opts.YearTo)
+	}
+
+	result, mirror, err := withMirrors(ctx, env.AnnasBaseURLs, "search", func(baseURL string) (*SearchResult, error) {
+		return findBookOn(ctx, env, baseURL, opts, content, page)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Mirror = mirror
+
+	return result, nil
+}
+
+// findBookOn fetches a page of search results from a single mirror.
+func findBookOn(ctx context.Context, env *env.Env, baseURL string, opts SearchOptions, content string, page int) (*SearchResult, error) {
 	l := logger.GetLogger()
 
 	// Use mutex to protect concurrent slice access
@@ -117,7 +361,10 @@ func FindBook(query string, content string) ([]*Book, error) {
 		colly.Async(true),
 		// Set realistic User-Agent to avoid DDoS-Guard blocking
 		colly.UserAgent(BrowserUserAgent),
+		colly.StdlibContext(ctx),
 	)
+	c.WithTransport(newTransport(env.Timeouts))
+	c.SetRequestTimeout(requestTimeout(env.Timeouts))
 
 	c.OnHTML("a[href^='/md5/']", func(e *colly.HTMLElement) {
 		// Only process the first link (the cover image link), not the duplicate title link
@@ -128,35 +375,58 @@ func FindBook(query string, content string) ([]*Book, error) {
 		}
 	})
 
+	// The pagination bar links to the following pages; any link pointing past
+	// the current page means there are more results to fetch.
+	hasMore := false
+	c.OnHTML("a[href^='/search']", func(e *colly.HTMLElement) {
+		if linkedPage(e.Attr("href")) > page {
+			bookListMutex.Lock()
+			hasMore = true
+			bookListMutex.Unlock()
+		}
+	})
+
 	c.OnRequest(func(r *colly.Request) {
 		l.Info("Visiting URL", zap.String("url", r.URL.String()))
 	})
 
 	// Add error handler
+	var visitErr error
 	c.OnError(func(r *colly.Response, err error) {
 		status := 0
 		if r != nil {
 			status = r.StatusCode
 		}
 		l.Error("Search request failed",
+			zap.String("mirror", baseURL),
 			zap.Int("statusCode", status),
 			zap.Error(err),
 		)
+		bookListMutex.Lock()
+		visitErr = checkMirrorResponse(ctx, status, err)
+		bookListMutex.Unlock()
 	})
 
-	env, err := env.GetEnv()
+	fullURL, err := buildSearchURL(baseURL, opts, content, page)
 	if err != nil {
 		return nil, err
 	}
 
-	fullURL := fmt.Sprintf(AnnasSearchEndpointFormat, env.AnnasBaseURL, url.QueryEscape(query), url.QueryEscape(content))
-
 	if err := c.Visit(fullURL); err != nil {
 		l.Error("Failed to visit search URL", zap.String("url", fullURL), zap.Error(err))
 		return nil, fmt.Errorf("failed to visit search URL: %w", err)
 	}
 	c.Wait()
 
+	// Failed requests of an async collector only reach OnError, so a
+	// cancelled search would otherwise look like one without results
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("search cancelled: %w", err)
+	}
+	if isMirrorDown(visitErr) {
+		return nil, fmt.Errorf("failed to visit search URL: %w", visitErr)
+	}
+
 	bookListParsed := make([]*Book, 0)
 	for _, e := range bookList {
 		// Validate that parent and container elements exist
@@ -190,7 +460,10 @@ func FindBook(query string, content string) ([]*Book, error) {
 
 		// Extract metadata
 		meta := bookInfoDiv.Find("div.text-gray-800").Text()
-		language, format, size := extractMetaInformation(meta)
+		info := extractMetaInformation(meta)
+		if !inYearRange(info.Year, opts) {
+			continue
+		}
 
 		// Extract link and hash
 		link := e.Attr("href")
@@ -205,14 +478,18 @@ func FindBook(query string, content string) ([]*Book, error) {
 		}
 
 		book := &Book{
-			Language:  language,
-			Format:    format,
-			Size:      size,
-			Title:     title,
-			Publisher: publisher,
-			Authors:   authors,
-			URL:       e.Request.AbsoluteURL(link),
-			Hash:      hash,
+			Language:    info.Language,
+			Format:      info.Format,
+			Size:        info.Size,
+			SizeBytes:   info.SizeBytes,
+			Year:        info.Year,
+			ContentType: info.ContentType,
+			Collections: info.Collections,
+			Title:       title,
+			Publisher:   publisher,
+			Authors:     authors,
+			URL:         e.Request.AbsoluteURL(link),
+			Hash:        hash,
 		}
 
 		bookListParsed = append(bookListParsed, book)
@@ -220,185 +497,235 @@ func FindBook(query string, content string) ([]*Book, error) {
 
 	// Log result count for debugging
 	l.Info("Search completed",
+		zap.Int("page", page),
 		zap.Int("totalElements", len(bookList)),
 		zap.Int("validBooks", len(bookListParsed)),
+		zap.Bool("hasMore", hasMore),
 	)
 
-	return bookListParsed, nil
+	return &SearchResult{
+		Books:   bookListParsed,
+		Page:    page,
+		HasMore: hasMore,
+	}, nil
+}
+
+// linkedPage returns the page number a search link points to, or 0 if the
+// link carries no page parameter.
+func linkedPage(href string) int {
+	u, err := url.Parse(href)
+	if err != nil {
+		return 0
+	}
+	page, err := strconv.Atoi(u.Query().Get("page"))
+	if err != nil {
+		return 0
+	}
+	return page
 }
 
-func (b *Book) Download(secretKey, folderPath string) error {
+// Download downloads the file through the fast download API.
+func (b *Book) Download(ctx context.Context, secretKey, folderPath string, opts *DownloadOptions) (*DownloadResult, error) {
 	l := logger.GetLogger()
 
-	env, err := env.GetEnv()
+	env, err := env.FromContext(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+		return nil, fmt.Errorf("failed to get environment: %w", err)
 	}
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: HTTPTimeout,
-	}
+	timeouts := opts.timeouts(env)
+	client := newAPIClient(timeouts)
 
 	// First API call: get download URL
-	apiURL := fmt.Sprintf(AnnasDownloadEndpointFormat, env.AnnasBaseURL, b.Hash, secretKey)
-
 	l.Info("Fetching download URL", zap.String("hash", b.Hash))
 
-	resp, err := client.Get(apiURL)
+	apiResp, mirror, err := withMirrors(ctx, env.AnnasBaseURLs, "fast_download", func(baseURL string) (*fastDownloadResponse, error) {
+		return fetchFastDownload(ctx, client, baseURL, b.Hash, secretKey)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to fetch download URL: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Validate HTTP status code
-	if resp.StatusCode != http.StatusOK {
-		body, readErr := io.ReadAll(io.LimitReader(resp.Body, 512))
-		if readErr != nil {
-			return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, resp.Status)
-		}
-		return fmt.Errorf("API request failed with status %d: %s (body: %s)", resp.StatusCode, resp.Status, string(body))
-	}
-
-	var apiResp fastDownloadResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		return fmt.Errorf("failed to decode API response: %w", err)
+		return nil, err
 	}
-
-	if apiResp.DownloadURL == "" {
-		if apiResp.Error != "" {
-			return fmt.Errorf("API error: %s", apiResp.Error)
-		}
-		return errors.New("API returned empty download URL")
+	downloadURL := apiResp.DownloadURL
+
+	var downloadsLeft *int
+	if apiResp.AccountInfo != nil {
+		downloadsLeft = &apiResp.AccountInfo.DownloadsLeft
+		l.Info("Fast download quota",
+			zap.Int("downloadsLeft", apiResp.AccountInfo.DownloadsLeft),
+			zap.Int("downloadsPerDay", apiResp.AccountInfo.DownloadsPerDay),
+		)
+		saveAccountStatus(env, newAccountStatus(apiResp.AccountInfo, mirror))
 	}
 
-	// Second API call: download the file
-	l.Info("Downloading file", zap.String("url", apiResp.DownloadURL))
-
-	downloadResp, err := client.Get(apiResp.DownloadURL)
-	if err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
+	format := strings.ToLower(b.Format)
+	if format == "" {
+		format = "bin"
 	}
-	defer downloadResp.Body.Close()
 
-	// Validate download status code
-	if downloadResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed with status %d: %s", downloadResp.StatusCode, downloadResp.Status)
+	year := ""
+	if b.Year != 0 {
+		year = strconv.Itoa(b.Year)
 	}
 
 	// Sanitize filename to prevent path traversal and invalid characters
-	safeTitle := sanitizeFilename(b.Title)
+	safeTitle := sanitizeFilename(expandFilenameTemplate(env.FilenameTemplate, map[string]string{
+		"title":     b.Title,
+		"authors":   b.Authors,
+		"publisher": b.Publisher,
+		"year":      year,
+		"language":  b.Language,
+		"format":    format,
+		"hash":      b.Hash,
+	}))
 	if safeTitle == "" {
 		safeTitle = "untitled"
 	}
 
-	format := strings.ToLower(b.Format)
-	if format == "" {
-		format = "bin"
-	}
-
 	filename := safeTitle + "." + format
 	filePath := filepath.Join(folderPath, filename)
+	partPath := partFilePath(folderPath, sanitizeFilename(strings.ToLower(b.Hash)))
+	unlock := lockPartFile(partPath)
+	defer unlock()
 
-	l.Info("Creating file", zap.String("path", filePath))
+	// Second API call: download the file
+	l.Info("Downloading file",
+		zap.String("url", downloadURL),
+		zap.String("path", partPath),
+	)
 
-	// Create the file
-	out, err := os.Create(filePath)
+	digest := md5.New()
+	t := &transfer{
+		newRequest: func() (*http.Request, error) {
+			return http.NewRequest("GET", downloadURL, nil)
+		},
+		partPath:  partPath,
+		digest:    digest,
+		progress:  opts.progress(),
+		hostLimit: opts.hostLimit(),
+		timeouts:  timeouts,
+	}
+	_, written, err := t.run(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-
-	// Setup cleanup on error
-	success := false
-	defer func() {
-		out.Close()
-		if !success {
-			// Delete partial file on failure
-			if removeErr := os.Remove(filePath); removeErr != nil {
-				l.Warn("Failed to remove partial file",
-					zap.String("path", filePath),
-					zap.Error(removeErr),
-				)
-			}
-		}
-	}()
+		return nil, err
+	}
 
-	// Copy the downloaded content
-	written, err := io.Copy(out, downloadResp.Body)
+	// Books are addressed by the MD5 of the file, so anything else is a
+	// truncated file or an error page
+	sum, err := verifyMD5(digest, b.Hash, partPath)
 	if err != nil {
-		return fmt.Errorf("failed to write file (wrote %d bytes): %w", written, err)
+		l.Error("Downloaded file failed verification",
+			zap.String("hash", b.Hash),
+			zap.String("md5", sum),
+			zap.Error(err),
+		)
+		return nil, err
 	}
 
-	// Sync to disk to ensure data is written
-	if err := out.Sync(); err != nil {
-		return fmt.Errorf("failed to sync file to disk: %w", err)
+	filePath, err = finishPartFile(partPath, filePath, sum)
+	if err != nil {
+		return nil, err
 	}
 
-	success = true
 	l.Info("Download completed successfully",
 		zap.String("path", filePath),
 		zap.Int64("bytes", written),
+		zap.String("md5", sum),
 	)
 
-	return nil
+	return &DownloadResult{
+		Path:          filePath,
+		Bytes:         written,
+		MD5:           sum,
+		Verified:      true,
+		Hash:          strings.ToLower(b.Hash),
+		Title:         b.Title,
+		Authors:       b.Authors,
+		Source:        SourceFastDownload,
+		Mirror:        mirror,
+		DownloadsLeft: downloadsLeft,
+	}, nil
 }
 
-func LookupDOI(doi string) (*Paper, error) {
-	l := logger.GetLogger()
+// fetchFastDownload asks a mirror's fast download API for the URL of a file.
+// Errors answered by the API are returned as a *FastDownloadError.
+func fetchFastDownload(ctx context.Context, client *http.Client, baseURL, hash, secretKey string) (*fastDownloadResponse, error) {
+	apiURL := fmt.Sprintf(AnnasDownloadEndpointFormat, baseURL, hash, url.QueryEscape(secretKey))
 
-	env, err := env.GetEnv()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, checkMirrorResponse(ctx, 0, fmt.Errorf("failed to fetch download URL: %w", err))
 	}
+	defer resp.Body.Close()
 
-	paper := &Paper{DOI: doi}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, checkMirrorResponse(ctx, 0, fmt.Errorf("failed to read API response: %w", err))
+	}
 
-	// Phase 1: Visit /scidb/DOI which redirects to a search results page.
-	// Extract the MD5 hash from the first search result.
-	searchCollector := colly.NewCollector(
-		colly.UserAgent(BrowserUserAgent),
-	)
+	// The API describes its errors in the JSON body, along with a matching
+	// status code
+	var apiResp fastDownloadResponse
+	decodeErr := json.Unmarshal(body, &apiResp)
 
-	searchCollector.OnHTML("a[href^='/md5/']", func(e *colly.HTMLElement) {
-		if paper.Hash != "" {
-			return
-		}
-		href := e.Attr("href")
-		hash := strings.TrimPrefix(href, "/md5/")
-		if hash != "" {
-			paper.Hash = hash
+	// Validate HTTP status code
+	if resp.StatusCode != http.StatusOK {
+		message := apiResp.Error
+		if decodeErr != nil || message == "" {
+			message = strings.TrimSpace(string(body[:min(len(body), 512)]))
 		}
-	})
+		return nil, checkMirrorResponse(ctx, resp.StatusCode, &FastDownloadError{
+			StatusCode: resp.StatusCode,
+			Message:    message,
+		})
+	}
 
-	searchCollector.OnError(func(r *colly.Response, err error) {
-		status := 0
-		if r != nil {
-			status = r.StatusCode
+	if decodeErr != nil {
+		return nil, fmt.Errorf("failed to decode API response: %w", decodeErr)
+	}
+
+	if apiResp.DownloadURL == "" {
+		if apiResp.Error != "" {
+			return nil, &FastDownloadError{StatusCode: resp.StatusCode, Message: apiResp.Error}
 		}
-		l.Error("SciDB search failed",
-			zap.String("doi", doi),
-			zap.Int("statusCode", status),
-			zap.Error(err),
-		)
-	})
+		return nil, errors.New("API returned empty download URL")
+	}
 
-	scidbURL := fmt.Sprintf(AnnasSciDBEndpointFormat, env.AnnasBaseURL, doi)
-	paper.PageURL = scidbURL
+	return &apiResp, nil
+}
 
-	l.Info("Looking up DOI", zap.String("url", scidbURL))
+func LookupDOI(ctx context.Context, doi string) (*Paper, error) {
+	l := logger.GetLogger()
 
-	if err := searchCollector.Visit(scidbURL); err != nil {
-		return nil, fmt.Errorf("failed to lookup DOI: %w", err)
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if paper.Hash == "" {
-		return nil, fmt.Errorf("no paper found for DOI: %s", doi)
+	paper := &Paper{DOI: doi}
+
+	// Phase 1: Visit /scidb/DOI which redirects to a search results page.
+	// Extract the MD5 hash from the first search result.
+	hash, mirror, err := withMirrors(ctx, env.AnnasBaseURLs, "doi", func(baseURL string) (string, error) {
+		return lookupDOIHash(ctx, env, baseURL, doi)
+	})
+	if err != nil {
+		return nil, err
 	}
+	paper.Hash = hash
+	paper.Mirror = mirror
+	paper.PageURL = fmt.Sprintf(AnnasSciDBEndpointFormat, mirror, doi)
 
 	// Phase 2: Visit /md5/HASH to get paper details.
 	detailCollector := colly.NewCollector(
 		colly.UserAgent(BrowserUserAgent),
+		colly.StdlibContext(ctx),
 	)
+	detailCollector.WithTransport(newTransport(env.Timeouts))
+	detailCollector.SetRequestTimeout(requestTimeout(env.Timeouts))
 
 	detailCollector.OnHTML("title", func(e *colly.HTMLElement) {
 		title := e.Text
@@ -443,10 +770,13 @@ func LookupDOI(doi string) (*Paper, error) {
 		l.Warn("Failed to fetch paper details", zap.String("hash", paper.Hash), zap.Error(err))
 	})
 
-	md5URL := fmt.Sprintf("https://%s/md5/%s", env.AnnasBaseURL, paper.Hash)
+	md5URL := fmt.Sprintf(AnnasMD5EndpointFormat, mirror, paper.Hash)
 	l.Info("Fetching paper details", zap.String("url", md5URL))
 
 	if err := detailCollector.Visit(md5URL); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("DOI lookup cancelled: %w", ctx.Err())
+		}
 		l.Warn("Failed to visit paper detail page", zap.Error(err))
 		// Non-fatal: we still have the hash for downloading
 	}
@@ -457,120 +787,443 @@ func LookupDOI(doi string) (*Paper, error) {
 	return paper, nil
 }
 
-func (p *Paper) Download(folderPath string) error {
+// lookupDOIHash resolves a DOI to the MD5 of its file on a single mirror.
+func lookupDOIHash(ctx context.Context, env *env.Env, baseURL, doi string) (string, error) {
+	l := logger.GetLogger()
+
+	searchCollector := colly.NewCollector(
+		colly.UserAgent(BrowserUserAgent),
+		colly.StdlibContext(ctx),
+	)
+	searchCollector.WithTransport(newTransport(env.Timeouts))
+	searchCollector.SetRequestTimeout(requestTimeout(env.Timeouts))
+
+	hash := ""
+	searchCollector.OnHTML("a[href^='/md5/']", func(e *colly.HTMLElement) {
+		if hash != "" {
+			return
+		}
+		hash = strings.TrimPrefix(e.Attr("href"), "/md5/")
+	})
+
+	status := 0
+	searchCollector.OnError(func(r *colly.Response, err error) {
+		if r != nil {
+			status = r.StatusCode
+		}
+		l.Error("SciDB search failed",
+			zap.String("doi", doi),
+			zap.String("mirror", baseURL),
+			zap.Int("statusCode", status),
+			zap.Error(err),
+		)
+	})
+
+	scidbURL := fmt.Sprintf(AnnasSciDBEndpointFormat, baseURL, doi)
+
+	l.Info("Looking up DOI", zap.String("url", scidbURL))
+
+	if err := searchCollector.Visit(scidbURL); err != nil {
+		return "", checkMirrorResponse(ctx, status, fmt.Errorf("failed to lookup DOI: %w", err))
+	}
+
+	if hash == "" {
+		return "", fmt.Errorf("%w: %s", ErrPaperNotFound, doi)
+	}
+
+	return hash, nil
+}
+
+func GetBookDetails(ctx context.Context, hash string) (*BookDetails, error) {
+	if !md5HashRegex.MatchString(hash) {
+		return nil, fmt.Errorf("invalid MD5 hash: %s", hash)
+	}
+
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	details, _, err := withMirrors(ctx, env.AnnasBaseURLs, "details", func(baseURL string) (*BookDetails, error) {
+		return getBookDetailsOn(ctx, env, baseURL, hash)
+	})
+	return details, err
+}
+
+// getBookDetailsOn scrapes the record page of a book on a single mirror.
+func getBookDetailsOn(ctx context.Context, env *env.Env, baseURL, hash string) (*BookDetails, error) {
+	l := logger.GetLogger()
+
+	details := &BookDetails{
+		Hash: strings.ToLower(hash),
+		URL:  fmt.Sprintf(AnnasMD5EndpointFormat, baseURL, strings.ToLower(hash)),
+	}
+
+	c := colly.NewCollector(
+		colly.UserAgent(BrowserUserAgent),
+		colly.StdlibContext(ctx),
+	)
+	c.WithTransport(newTransport(env.Timeouts))
+	c.SetRequestTimeout(requestTimeout(env.Timeouts))
+
+	c.OnHTML("title", func(e *colly.HTMLElement) {
+		if details.Title != "" {
+			return
+		}
+		title := e.Text
+		if idx := strings.Index(title, " - Anna"); idx > 0 {
+			details.Title = strings.TrimSpace(title[:idx])
+		}
+	})
+
+	// The main title of the record, preferred over the page title
+	c.OnHTML("div.text-3xl.font-bold", func(e *colly.HTMLElement) {
+		if title := strings.TrimSpace(e.Text); title != "" {
+			details.Title = title
+		}
+	})
+
+	c.OnHTML("meta[property='og:image']", func(e *colly.HTMLElement) {
+		if details.CoverURL == "" {
+			details.CoverURL = e.Request.AbsoluteURL(e.Attr("content"))
+		}
+	})
+
+	c.OnHTML("div.js-md5-top-box-description", func(e *colly.HTMLElement) {
+		if details.Description == "" {
+			details.Description = strings.TrimSpace(e.Text)
+		}
+	})
+
+	c.OnHTML("a[href^='/search']", func(e *colly.HTMLElement) {
+		text := strings.TrimSpace(e.Text)
+		switch {
+		case e.DOM.Find("span.icon-\\[mdi--user-edit\\]").Length() > 0:
+			if details.Authors == "" {
+				details.Authors = text
+			}
+		case e.DOM.Find("span.icon-\\[mdi--company\\]").Length() > 0:
+			if details.Publisher == "" {
+				details.Publisher = text
+			}
+		}
+	})
+
+	// The "·" separated meta line, as on the search results
+	c.OnHTML("div.text-gray-500", func(e *colly.HTMLElement) {
+		if details.Format != "" {
+			return
+		}
+		info := extractMetaInformation(e.Text)
+		if info.Format == "" {
+			return
+		}
+		details.Language = info.Language
+		details.Format = info.Format
+		details.Size = info.Size
+		details.SizeBytes = info.SizeBytes
+		details.Year = info.Year
+		details.ContentType = info.ContentType
+		details.Collections = info.Collections
+	})
+
+	// Metadata that has no dedicated element is rendered as a label followed by
+	// its value, e.g. "Alternative title" and then the title itself.
+	c.OnHTML("div", func(e *colly.HTMLElement) {
+		if e.DOM.Children().Length() > 0 {
+			return
+		}
+		value := strings.TrimSpace(e.DOM.Next().Text())
+		if value == "" {
+			return
+		}
+		switch strings.ToLower(strings.TrimSpace(e.Text)) {
+		case "alternative title":
+			details.AlternativeTitles = appendUnique(details.AlternativeTitles, value)
+		case "alternative author":
+			details.AlternativeAuthors = appendUnique(details.AlternativeAuthors, value)
+		case "alternative edition", "edition":
+			if details.Edition == "" {
+				details.Edition = value
+			}
+		case "series":
+			if details.Series == "" {
+				details.Series = value
+			}
+		case "alternative description", "description":
+			if details.Description == "" {
+				details.Description = value
+			}
+		}
+	})
+
+	c.OnHTML("a.js-download-link", func(e *colly.HTMLElement) {
+		details.Mirrors = appendUnique(details.Mirrors, e.Text)
+	})
+
+	c.OnHTML("a[href^='/md5/']", func(e *colly.HTMLElement) {
+		other := strings.ToLower(strings.TrimPrefix(e.Attr("href"), "/md5/"))
+		title := strings.TrimSpace(e.Text)
+		if other == details.Hash || !md5HashRegex.MatchString(other) || title == "" {
+			return
+		}
+		for _, version := range details.OtherVersions {
+			if version.Hash == other {
+				return
+			}
+		}
+		details.OtherVersions = append(details.OtherVersions, &BookVersion{
+			Hash:  other,
+			Title: title,
+			URL:   e.Request.AbsoluteURL(e.Attr("href")),
+		})
+	})
+
+	c.OnHTML("body", func(e *colly.HTMLElement) {
+		for _, matches := range isbnRegex.FindAllStringSubmatch(e.Text, -1) {
+			details.ISBNs = appendUnique(details.ISBNs, normalizeISBN(matches[1]))
+		}
+	})
+
+	status := 0
+	c.OnError(func(r *colly.Response, err error) {
+		if r != nil {
+			status = r.StatusCode
+		}
+		l.Error("Book details request failed",
+			zap.String("hash", details.Hash),
+			zap.String("mirror", baseURL),
+			zap.Int("statusCode", status),
+			zap.Error(err),
+		)
+	})
+
+	l.Info("Fetching book details", zap.String("url", details.URL))
+
+	if err := c.Visit(details.URL); err != nil {
+		return nil, checkMirrorResponse(ctx, status, fmt.Errorf("failed to fetch book details: %w", err))
+	}
+
+	if details.Title == "" {
+		return nil, fmt.Errorf("no book found for hash: %s", hash)
+	}
+
+	if details.Edition == "" {
+		if match := editionRegex.FindString(details.Publisher); match != "" {
+			details.Edition = match
+		}
+	}
+
+	l.Info("Book details fetched",
+		zap.String("hash", details.Hash),
+		zap.Int("isbns", len(details.ISBNs)),
+		zap.Int("otherVersions", len(details.OtherVersions)),
+	)
+
+	return details, nil
+}
+
+// Download downloads the paper through SciDB.
+func (p *Paper) Download(ctx context.Context, folderPath string, opts *DownloadOptions) (*DownloadResult, error) {
 	l := logger.GetLogger()
 
 	if p.DownloadURL == "" {
-		return errors.New("no download URL available for this paper")
+		return nil, errors.New("no download URL available for this paper")
 	}
 
-	env, err := env.GetEnv()
+	env, err := env.FromContext(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+		return nil, fmt.Errorf("failed to get environment: %w", err)
 	}
 
 	// Construct full download URL
 	downloadURL := p.DownloadURL
 	if !strings.HasPrefix(downloadURL, "http") {
-		downloadURL = fmt.Sprintf("https://%s%s", env.AnnasBaseURL, downloadURL)
+		// Download from the mirror the paper was looked up on
+		baseURL := p.Mirror
+		if baseURL == "" {
+			baseURL = env.AnnasBaseURL
+		}
+		downloadURL = fmt.Sprintf("https://%s%s", baseURL, downloadURL)
 	}
 
-	client := &http.Client{
-		Timeout: 2 * HTTPTimeout,
+	// Build filename from title or DOI. The extension is only known once the
+	// server answers. The partial file is named after the DOI, and apart from
+	// the one of a fast download of the same paper, since SciDB may serve
+	// another copy.
+	title := p.Title
+	if title == "" {
+		title = p.DOI
 	}
+	safeName := sanitizeFilename(expandFilenameTemplate(env.FilenameTemplate, map[string]string{
+		"title":   title,
+		"authors": p.Authors,
+		"journal": p.Journal,
+		"doi":     p.DOI,
+		"hash":    p.Hash,
+	}))
+	if safeName == "" {
+		safeName = "paper"
+	}
+	doiSum := md5.Sum([]byte(strings.ToLower(p.DOI)))
+	partPath := partFilePath(folderPath, "scidb-"+hex.EncodeToString(doiSum[:]))
+	unlock := lockPartFile(partPath)
+	defer unlock()
+
+	l.Info("Downloading paper via SciDB",
+		zap.String("url", downloadURL),
+		zap.String("path", partPath),
+	)
 
-	l.Info("Downloading paper via SciDB", zap.String("url", downloadURL))
-
-	req, err := http.NewRequest("GET", downloadURL, nil)
+	digest := md5.New()
+	t := &transfer{
+		newRequest: func() (*http.Request, error) {
+			req, err := http.NewRequest("GET", downloadURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("User-Agent", BrowserUserAgent)
+			return req, nil
+		},
+		partPath:  partPath,
+		digest:    digest,
+		progress:  opts.progress(),
+		hostLimit: opts.hostLimit(),
+		timeouts:  opts.timeouts(env),
+	}
+	header, written, err := t.run(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to download paper: %w", err)
 	}
-	req.Header.Set("User-Agent", BrowserUserAgent)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to download paper: %w", err)
+	// SciDB may serve a different copy of the paper than the record the DOI
+	// resolved to, so a mismatch is reported rather than treated as a failure
+	sum := hex.EncodeToString(digest.Sum(nil))
+	verified := p.Hash != "" && strings.EqualFold(sum, p.Hash)
+	if p.Hash != "" && !verified {
+		l.Warn("Paper does not match the MD5 of its record",
+			zap.String("doi", p.DOI),
+			zap.String("expected", p.Hash),
+			zap.String("md5", sum),
+		)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, readErr := io.ReadAll(io.LimitReader(resp.Body, 512))
-		if readErr != nil {
-			return fmt.Errorf("download failed with status %d: %s", resp.StatusCode, resp.Status)
-		}
-		return fmt.Errorf("download failed with status %d: %s (body: %s)", resp.StatusCode, resp.Status, string(body))
+	filePath, err := finishPartFile(partPath, filepath.Join(folderPath, safeName+paperExtension(header, partPath)), sum)
+	if err != nil {
+		return nil, err
 	}
 
-	// Infer file extension from Content-Disposition or Content-Type
-	ext := ".pdf"
-	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
-		if _, params, err := mime.ParseMediaType(cd); err == nil {
-			if fn, ok := params["filename"]; ok {
-				if e := filepath.Ext(fn); e != "" {
-					ext = e
+	l.Info("Paper download completed successfully",
+		zap.String("path", filePath),
+		zap.Int64("bytes", written),
+		zap.String("md5", sum),
+		zap.Bool("verified", verified),
+	)
+
+	return &DownloadResult{
+		Path:     filePath,
+		Bytes:    written,
+		MD5:      sum,
+		Verified: verified,
+		Hash:     strings.ToLower(p.Hash),
+		DOI:      p.DOI,
+		Title:    p.Title,
+		Authors:  p.Authors,
+		Source:   SourceSciDB,
+		Mirror:   p.Mirror,
+	}, nil
+}
+
+// paperExtension infers the extension of a downloaded paper from the
+// Content-Disposition or Content-Type of the response that delivered it. When
+// the partial file was completed by an earlier process, there is no such
+// response, and the type is sniffed from the file itself.
+func paperExtension(header http.Header, partPath string) string {
+	if header != nil {
+		if cd := header.Get("Content-Disposition"); cd != "" {
+			if _, params, err := mime.ParseMediaType(cd); err == nil {
+				if e := filepath.Ext(params["filename"]); e != "" {
+					return e
 				}
 			}
+		} else if ct := header.Get("Content-Type"); ct != "" {
+			if exts, _ := mime.ExtensionsByType(ct); len(exts) > 0 {
+				return exts[0]
+			}
 		}
-	} else if ct := resp.Header.Get("Content-Type"); ct != "" {
-		exts, _ := mime.ExtensionsByType(ct)
-		if len(exts) > 0 {
-			ext = exts[0]
-		}
+		return ".pdf"
 	}
 
-	// Build filename from title or DOI
-	name := p.Title
-	if name == "" {
-		name = p.DOI
+	f, err := os.Open(partPath)
+	if err != nil {
+		return ".pdf"
 	}
-	safeName := sanitizeFilename(name)
-	if safeName == "" {
-		safeName = "paper"
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if exts, _ := mime.ExtensionsByType(http.DetectContentType(head[:n])); len(exts) > 0 {
+		return exts[0]
 	}
-	filename := safeName + ext
-	filePath := filepath.Join(folderPath, filename)
+	return ".pdf"
+}
 
-	l.Info("Creating file", zap.String("path", filePath))
+// DownloadPaper looks up a paper by its DOI and downloads it. The fast
+// download API is tried first when a secret key is given, since it serves
+// the exact file of the record, and SciDB otherwise or if that fails.
+func DownloadPaper(ctx context.Context, doi, secretKey, folderPath string, opts *DownloadOptions) (*DownloadResult, error) {
+	l := logger.GetLogger()
 
-	out, err := os.Create(filePath)
+	paper, err := LookupDOI(ctx, doi)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-
-	success := false
-	defer func() {
-		out.Close()
-		if !success {
-			if removeErr := os.Remove(filePath); removeErr != nil {
-				l.Warn("Failed to remove partial file",
-					zap.String("path", filePath),
-					zap.Error(removeErr),
-				)
-			}
-		}
-	}()
+		return nil, err
+	}
 
-	written, err := io.Copy(out, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write file (wrote %d bytes): %w", written, err)
+	if paper.Hash != "" && secretKey != "" {
+		book := &Book{
+			Hash:   paper.Hash,
+			Title:  paper.Title,
+			Format: "pdf",
+		}
+		result, err := book.Download(ctx, secretKey, folderPath, opts)
+		if err == nil {
+			l.Info("Paper downloaded via fast download",
+				zap.String("doi", doi),
+				zap.String("path", result.Path),
+			)
+			result.DOI = paper.DOI
+			result.Authors = paper.Authors
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		l.Warn("Fast download failed, trying SciDB download",
+			zap.String("doi", doi),
+			zap.Error(err),
+		)
 	}
 
-	if err := out.Sync(); err != nil {
-		return fmt.Errorf("failed to sync file to disk: %w", err)
+	result, err := paper.Download(ctx, folderPath, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	success = true
-	l.Info("Paper download completed successfully",
-		zap.String("path", filePath),
-		zap.Int64("bytes", written),
+	l.Info("Paper downloaded via SciDB",
+		zap.String("doi", doi),
+		zap.String("path", result.Path),
 	)
 
-	return nil
+	return result, nil
 }
 
 func (b *Book) String() string {
-	return fmt.Sprintf("Title: %s\nAuthors: %s\nPublisher: %s\nLanguage: %s\nFormat: %s\nSize: %s\nURL: %s\nHash: %s",
-		b.Title, b.Authors, b.Publisher, b.Language, b.Format, b.Size, b.URL, b.Hash)
+	year := ""
+	if b.Year != 0 {
+		year = strconv.Itoa(b.Year)
+	}
+
+	return fmt.Sprintf("Title: %s\nAuthors: %s\nPublisher: %s\nYear: %s\nLanguage: %s\nFormat: %s\nType: %s\nSize: %s\nCollections: %s\nURL: %s\nHash: %s",
+		b.Title, b.Authors, b.Publisher, year, b.Language, b.Format, b.ContentType, b.Size, strings.Join(b.Collections, ", "), b.URL, b.Hash)
 }
 
 func (b *Book) ToJSON() (string, error) {
@@ -0,0 +1,252 @@
+package anna
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestExtractMetaInformation(t *testing.T) {
+	tests := []struct {
+		name string
+		meta string
+		want metaInformation
+	}{
+		{
+			name: "book",
+			meta: "✅ English [en] · EPUB · 0.7MB · 2015 · 📘 Book (non-fiction) · 🚀/lgli/lgrs/zlib · Save",
+			want: metaInformation{
+				Language:    "English",
+				Format:      "EPUB",
+				Size:        "0.7MB",
+				SizeBytes:   700_000,
+				Year:        2015,
+				ContentType: "Book (non-fiction)",
+				Collections: []string{"lgli", "lgrs", "zlib"},
+			},
+		},
+		{
+			name: "several languages without year",
+			meta: "✅ English [en] · Hindi [hi] · PDF · 12.3MB · 📕 Book (fiction) · 🚀/zlib",
+			want: metaInformation{
+				Language:    "English",
+				Format:      "PDF",
+				Size:        "12.3MB",
+				SizeBytes:   12_300_000,
+				ContentType: "Book (fiction)",
+				Collections: []string{"zlib"},
+			},
+		},
+		{
+			name: "paper in kilobytes",
+			meta: "✅ English [en] · pdf · 512KB · 2019 · 📄 Journal article · 🚀/scihub",
+			want: metaInformation{
+				Language:    "English",
+				Format:      "PDF",
+				Size:        "512KB",
+				SizeBytes:   512_000,
+				Year:        2019,
+				ContentType: "Journal article",
+				Collections: []string{"scihub"},
+			},
+		},
+		{
+			name: "unknown content type and no collections",
+			meta: "✅ German [de] · DJVU · 1.5GB · 1987 · ❓ Unknown",
+			want: metaInformation{
+				Language:  "German",
+				Format:    "DJVU",
+				Size:      "1.5GB",
+				SizeBytes: 1_500_000_000,
+				Year:      1987,
+			},
+		},
+		{
+			name: "number that is not a year",
+			meta: "✅ French [fr] · MOBI · 2.0MB · 123 · 📘 Book (unknown)",
+			want: metaInformation{
+				Language:    "French",
+				Format:      "MOBI",
+				Size:        "2.0MB",
+				SizeBytes:   2_000_000,
+				ContentType: "Book (unknown)",
+			},
+		},
+		{
+			name: "too short",
+			meta: "✅ English [en] · EPUB",
+			want: metaInformation{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractMetaInformation(tt.meta); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractMetaInformation() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+	}{
+		{"0.7MB", 700_000},
+		{"12MB", 12_000_000},
+		{"3.5 GB", 3_500_000_000},
+		{"512KB", 512_000},
+		{"1.2kb", 1_200},
+		{"900B", 900},
+		{"2TB", 2_000_000_000_000},
+		{"MB", 0},
+		{"about 3", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseSize(tt.size); got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestExtractCollections(t *testing.T) {
+	tests := []struct {
+		meta string
+		want []string
+	}{
+		{"✅ English [en] · EPUB · 0.7MB · 🚀/lgli/lgrs/zlib", []string{"lgli", "lgrs", "zlib"}},
+		{"✅ English [en] · PDF · 1.0MB · 🚀/ia", []string{"ia"}},
+		{"✅ English [en] · PDF · 1.0MB · 🚀/lgli/zlib/", []string{"lgli", "zlib"}},
+		// Slashes in titles, file names and numbers are not collections
+		{"✅ English [en] · PDF · 1.0MB · Input/Output in practice · 🚀/zlib", []string{"zlib"}},
+		{"✅ English [en] · PDF · 1/2 · 2001", nil},
+		{"✅ English [en] · PDF · 1.0MB · 🚀/", nil},
+		{"✅ English [en] · PDF · 1.0MB", nil},
+	}
+
+	for _, tt := range tests {
+		if got := extractCollections(tt.meta); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("extractCollections(%q) = %q, want %q", tt.meta, got, tt.want)
+		}
+	}
+}
+
+func TestBuildSearchURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    SearchOptions
+		content string
+		page    int
+		want    url.Values
+		wantErr bool
+	}{
+		{
+			name:    "query only",
+			opts:    SearchOptions{Query: "go programming"},
+			content: "book_any",
+			page:    1,
+			want:    url.Values{"q": {"go programming"}, "content": {"book_any"}, "page": {"1"}},
+		},
+		{
+			name: "repeated filters",
+			opts: SearchOptions{
+				Query:      "physics",
+				Languages:  []string{"EN", " de "},
+				Extensions: []string{".PDF", "epub"},
+				Sources:    []string{"lgli", "ZLIB"},
+			},
+			content: "journal",
+			page:    3,
+			want: url.Values{
+				"q":       {"physics"},
+				"content": {"journal"},
+				"lang":    {"en", "de"},
+				"ext":     {"pdf", "epub"},
+				"src":     {"lgli", "zlib"},
+				"page":    {"3"},
+			},
+		},
+		{
+			name:    "relevance is the default order",
+			opts:    SearchOptions{Query: "x", Sort: "relevant"},
+			content: "book_any",
+			page:    1,
+			want:    url.Values{"q": {"x"}, "content": {"book_any"}, "page": {"1"}},
+		},
+		{
+			name:    "sort by publication year",
+			opts:    SearchOptions{Query: "x", Sort: "Newest"},
+			content: "book_any",
+			page:    1,
+			want:    url.Values{"q": {"x"}, "content": {"book_any"}, "sort": {"newest"}, "page": {"1"}},
+		},
+		{
+			name:    "sort by date added",
+			opts:    SearchOptions{Query: "x", Sort: "oldest_added"},
+			content: "book_any",
+			page:    2,
+			want:    url.Values{"q": {"x"}, "content": {"book_any"}, "sort": {"oldest_added"}, "page": {"2"}},
+		},
+		{
+			name:    "unknown sort order",
+			opts:    SearchOptions{Query: "x", Sort: "popular"},
+			content: "book_any",
+			page:    1,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildSearchURL("annas-archive.li", tt.opts, tt.content, tt.page)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildSearchURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			parsed, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Scheme != "https" || parsed.Host != "annas-archive.li" || parsed.Path != "/search" {
+				t.Errorf("buildSearchURL() = %s, want the search page of the mirror", got)
+			}
+			if query := parsed.Query(); !reflect.DeepEqual(query, tt.want) {
+				t.Errorf("buildSearchURL() query = %v, want %v", query, tt.want)
+			}
+		})
+	}
+}
+
+func TestInYearRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		year     int
+		from, to int
+		want     bool
+	}{
+		{name: "no range", year: 1999, want: true},
+		{name: "no range and no year", year: 0, want: true},
+		{name: "unknown year with a range", year: 0, from: 2000, want: false},
+		{name: "before from", year: 1999, from: 2000, want: false},
+		{name: "at from", year: 2000, from: 2000, want: true},
+		{name: "after to", year: 2011, to: 2010, want: false},
+		{name: "at to", year: 2010, to: 2010, want: true},
+		{name: "inside", year: 2005, from: 2000, to: 2010, want: true},
+		{name: "outside", year: 2015, from: 2000, to: 2010, want: false},
+		{name: "single year", year: 2020, from: 2020, to: 2020, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inYearRange(tt.year, SearchOptions{YearFrom: tt.from, YearTo: tt.to}); got != tt.want {
+				t.Errorf("inYearRange(%d, %d-%d) = %v, want %v", tt.year, tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,520 @@
+package anna
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	DownloadRetries    = 3
+	DownloadRetryDelay = 2 * time.Second
+	PartFileSuffix     = ".part"
+	CorruptFileSuffix  = ".corrupt"
+	ProgressInterval   = 500 * time.Millisecond
+
+	// maxNameSuffix bounds the numbered names tried for a download whose
+	// file name is taken, e.g. "Title (2).pdf".
+	maxNameSuffix = 100
+)
+
+// ErrChecksumMismatch is returned when a downloaded file does not hash to the
+// MD5 it was requested by.
+var ErrChecksumMismatch = errors.New("MD5 checksum mismatch")
+
+// retryableError marks transfer failures worth another attempt, such as
+// dropped connections and 5xx responses.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+func (e *retryableError) Unwrap() error { return e.err }
+
+func retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+func isRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r)
+}
+
+// errIdleTimeout cancels a transfer that stopped receiving data.
+var errIdleTimeout = errors.New("no data received within the idle timeout")
+
+// partLocks serializes the downloads sharing a partial file, which are
+// downloads of the same file, by path.
+var partLocks sync.Map
+
+// lockPartFile waits for other downloads into path in this process to end,
+// and returns the function releasing it.
+func lockPartFile(path string) func() {
+	mu, _ := partLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// ErrSuspended, given as the cause when cancelling the context of a download,
+// stops it like any cancellation but keeps its partial file, so that it can
+// be resumed later.
+var ErrSuspended = errors.New("download suspended")
+
+// newTransport returns an HTTP transport enforcing the connection and
+// response header timeouts.
+func newTransport(t env.Timeouts) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   t.Connect,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = t.Connect
+	transport.ResponseHeaderTimeout = t.ResponseHeader
+	return transport
+}
+
+// newAPIClient returns a client for small requests, such as JSON API calls,
+// which are bounded as a whole by requestTimeout.
+func newAPIClient(t env.Timeouts) *http.Client {
+	return &http.Client{
+		Timeout:   requestTimeout(t),
+		Transport: newTransport(t),
+	}
+}
+
+// requestTimeout bounds a small request as a whole: connecting, waiting for
+// the answer and receiving it, and never more than the total timeout. It is
+// unlimited when any of these phases is.
+func requestTimeout(t env.Timeouts) time.Duration {
+	var timeout time.Duration
+	if t.Connect > 0 && t.ResponseHeader > 0 && t.Idle > 0 {
+		timeout = t.Connect + t.ResponseHeader + t.Idle
+	}
+	if t.Total > 0 && (timeout == 0 || t.Total < timeout) {
+		timeout = t.Total
+	}
+	return timeout
+}
+
+// partFilePath returns the partial file of a download, named after what
+// identifies the file rather than after its final name, so that different
+// files with the same title never share one.
+func partFilePath(folderPath, id string) string {
+	return filepath.Join(folderPath, id+PartFileSuffix)
+}
+
+// transfer downloads a single file into partPath, resuming from whatever a
+// previous attempt left there. Dropped transfers are retried with a Range
+// request for the missing bytes; servers that ignore Range restart the file
+// from scratch. The partial file is kept on failure so that a later call can
+// pick it up, unless the caller cancels the context, in which case it is
+// removed.
+//
+// The bytes are fed to digest as they are written, so once run returns digest
+// holds the hash of the whole file without reading it back.
+type transfer struct {
+	newRequest func() (*http.Request, error)
+	partPath   string
+	digest     hash.Hash
+	progress   ProgressFunc
+	hostLimit  HostLimitFunc
+	timeouts   env.Timeouts
+
+	// header is the header of the last response that delivered bytes of the
+	// file
+	header http.Header
+}
+
+// run performs the transfer. It returns the headers of the last response
+// that delivered bytes of the file, which callers use to name the final file,
+// and the size of the completed file. The headers are nil if the partial
+// file was already complete, e.g. after a crash of a previous process.
+func (t *transfer) run(parent context.Context) (http.Header, int64, error) {
+	l := logger.GetLogger()
+
+	// Transfers are only bounded by the total timeout, if any, so that large
+	// files on slow mirrors can finish as long as data keeps arriving
+	client := &http.Client{Transport: newTransport(t.timeouts)}
+	ctx := parent
+	if t.timeouts.Total > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeouts.Total)
+		defer cancel()
+	}
+
+	if t.hostLimit != nil {
+		req, err := t.newRequest()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to create request: %w", err)
+		}
+		release, err := t.hostLimit(ctx, req.URL.Hostname())
+		if err != nil {
+			return nil, 0, t.interrupted(parent, err)
+		}
+		defer release()
+	}
+
+	var size int64
+	if info, err := os.Stat(t.partPath); err == nil {
+		size = info.Size()
+		l.Info("Resuming partial download",
+			zap.String("path", t.partPath),
+			zap.Int64("offset", size),
+		)
+	}
+
+	// The digest has to cover what is already on disk before appending to it.
+	// After a failed attempt it may be out of step with the file, so it is
+	// rebuilt from the file again.
+	stale := size > 0
+
+	var lastErr error
+	for attempt := 0; attempt <= DownloadRetries; attempt++ {
+		if attempt > 0 {
+			delay := time.Duration(attempt) * DownloadRetryDelay
+			l.Warn("Retrying download",
+				zap.String("path", t.partPath),
+				zap.Int("attempt", attempt),
+				zap.Int64("offset", size),
+				zap.Duration("delay", delay),
+				zap.Error(lastErr),
+			)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, size, t.interrupted(parent, lastErr)
+			}
+		}
+
+		if stale {
+			if err := hashFile(t.digest, t.partPath, size); err != nil {
+				return nil, size, err
+			}
+			stale = false
+		}
+
+		var header http.Header
+		var err error
+		header, size, err = t.attempt(ctx, client, size)
+		if err == nil {
+			return header, size, nil
+		}
+		if ctx.Err() != nil {
+			return nil, size, t.interrupted(parent, err)
+		}
+		if !isRetryable(err) {
+			return nil, size, err
+		}
+		stale = true
+		lastErr = err
+	}
+
+	return nil, size, fmt.Errorf("download failed after %d attempts (partial file kept at %s): %w", DownloadRetries+1, t.partPath, lastErr)
+}
+
+// interrupted builds the error for a transfer stopped by its context. A
+// cancelled transfer is abandoned, so its partial file is deleted; one that
+// ran out of time or was suspended keeps it for a later attempt.
+func (t *transfer) interrupted(parent context.Context, err error) error {
+	if parent.Err() == nil {
+		return fmt.Errorf("download exceeded the total timeout of %s (partial file kept at %s): %w", t.timeouts.Total, t.partPath, err)
+	}
+	if errors.Is(context.Cause(parent), ErrSuspended) {
+		return fmt.Errorf("%w (partial file kept at %s)", ErrSuspended, t.partPath)
+	}
+
+	if removeErr := os.Remove(t.partPath); removeErr != nil && !os.IsNotExist(removeErr) {
+		logger.GetLogger().Warn("Failed to remove partial file of cancelled download",
+			zap.String("path", t.partPath),
+			zap.Error(removeErr),
+		)
+	}
+	return fmt.Errorf("download cancelled: %w", parent.Err())
+}
+
+// attempt performs a single request, continuing the partial file from
+// offset. It returns the size of the partial file afterwards.
+func (t *transfer) attempt(parent context.Context, client *http.Client, offset int64) (http.Header, int64, error) {
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+
+	req, err := t.newRequest()
+	if err != nil {
+		return nil, offset, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, offset, retryable(fmt.Errorf("failed to download file: %w", err))
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && rangeStart(resp) == offset:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		// Either a fresh download or a server that ignores Range
+		flags |= os.O_TRUNC
+		offset = 0
+		t.digest.Reset()
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && rangeTotal(resp) == offset:
+		// A previous attempt already received every byte. The headers of
+		// this error response say nothing about the file.
+		return t.header, offset, nil
+	case resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file does not line up with what the server has, so
+		// throw it away and start over
+		if err := os.Truncate(t.partPath, 0); err != nil && !os.IsNotExist(err) {
+			return nil, offset, fmt.Errorf("failed to reset partial file: %w", err)
+		}
+		return nil, 0, retryable(fmt.Errorf("download failed with status %d: %s", resp.StatusCode, resp.Status))
+	default:
+		err := fmt.Errorf("download failed with status %d: %s", resp.StatusCode, resp.Status)
+		if body, readErr := io.ReadAll(io.LimitReader(resp.Body, 512)); readErr == nil && len(body) > 0 {
+			err = fmt.Errorf("download failed with status %d: %s (body: %s)", resp.StatusCode, resp.Status, string(body))
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, offset, retryable(err)
+		}
+		return nil, offset, err
+	}
+
+	out, err := os.OpenFile(t.partPath, flags, 0o644)
+	if err != nil {
+		return nil, offset, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer out.Close()
+	t.header = resp.Header
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	reporter := &progressWriter{done: offset, total: total, report: t.progress}
+
+	var body io.Reader = resp.Body
+	if t.timeouts.Idle > 0 {
+		body = newIdleReader(resp.Body, t.timeouts.Idle, cancel)
+	}
+
+	written, err := io.Copy(io.MultiWriter(out, t.digest, reporter), body)
+	reporter.flush()
+	if err == nil && resp.ContentLength > 0 && written < resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if errors.Is(context.Cause(ctx), errIdleTimeout) {
+		err = fmt.Errorf("transfer stalled for %s: %w", t.timeouts.Idle, errIdleTimeout)
+	}
+	if err != nil {
+		return nil, offset + written, retryable(fmt.Errorf("failed to write file (wrote %d bytes): %w", written, err))
+	}
+
+	if err := out.Sync(); err != nil {
+		return nil, offset + written, fmt.Errorf("failed to sync file to disk: %w", err)
+	}
+
+	return resp.Header, offset + written, nil
+}
+
+// idleReader cancels a transfer when no data has been read for a while. Each
+// successful read pushes the deadline back.
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleReader(r io.Reader, timeout time.Duration, cancel context.CancelCauseFunc) *idleReader {
+	return &idleReader{
+		r:       r,
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, func() { cancel(errIdleTimeout) }),
+	}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil {
+		r.timer.Stop()
+	}
+	return n, err
+}
+
+// progressWriter counts the bytes written through it and passes the running
+// total to a ProgressFunc, at most once per ProgressInterval.
+type progressWriter struct {
+	done     int64
+	total    int64
+	report   ProgressFunc
+	reported time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.done += int64(len(p))
+	if w.report != nil && time.Since(w.reported) >= ProgressInterval {
+		w.reported = time.Now()
+		w.report(w.done, w.total)
+	}
+	return len(p), nil
+}
+
+// flush reports the final count, which the interval may have skipped.
+func (w *progressWriter) flush() {
+	if w.report != nil {
+		w.report(w.done, w.total)
+	}
+}
+
+// rangeStart returns the first byte position of a Content-Range header such
+// as "bytes 100-999/1000", or -1 if it cannot be parsed.
+func rangeStart(resp *http.Response) int64 {
+	unit, spec, ok := strings.Cut(resp.Header.Get("Content-Range"), " ")
+	if !ok || unit != "bytes" {
+		return -1
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// rangeTotal returns the complete length from a Content-Range header such as
+// "bytes */1000", or -1 if it is unknown.
+func rangeTotal(resp *http.Response) int64 {
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// hashFile resets digest and feeds it the first size bytes of path.
+func hashFile(digest hash.Hash, path string, size int64) error {
+	digest.Reset()
+	if size == 0 {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open partial file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(digest, f, size); err != nil {
+		return fmt.Errorf("failed to hash partial file: %w", err)
+	}
+	return nil
+}
+
+// fileMD5 returns the MD5 of the file at path.
+func fileMD5(path string) (string, error) {
+	digest := md5.New()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// verifyMD5 compares the digest of a completed partial file with the expected
+// hash. On mismatch the file is moved aside with CorruptFileSuffix, so it is
+// neither mistaken for a good download nor resumed by the next attempt.
+func verifyMD5(digest hash.Hash, expected, partPath string) (string, error) {
+	actual := hex.EncodeToString(digest.Sum(nil))
+	if strings.EqualFold(actual, expected) {
+		return actual, nil
+	}
+
+	corruptPath := strings.TrimSuffix(partPath, PartFileSuffix) + CorruptFileSuffix
+	if err := os.Rename(partPath, corruptPath); err != nil {
+		return actual, fmt.Errorf("%w: expected %s, got %s (failed to quarantine file: %v)", ErrChecksumMismatch, expected, actual, err)
+	}
+	return actual, fmt.Errorf("%w: expected %s, got %s (file quarantined at %s)", ErrChecksumMismatch, expected, actual, corruptPath)
+}
+
+// finishPartFile moves a completed partial file, whose MD5 is sum, to
+// filePath and returns where it ended up. Another file already at filePath is
+// kept, and the download gets a numbered name next to it instead, such as
+// "Title (2).pdf". A copy of the same file is replaced.
+func finishPartFile(partPath, filePath, sum string) (string, error) {
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filePath, ext)
+
+	for n := 1; n <= maxNameSuffix; n++ {
+		candidate := filePath
+		if n > 1 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		free, err := claimPath(candidate, sum)
+		if err != nil {
+			return "", err
+		}
+		if !free {
+			continue
+		}
+
+		if err := os.Rename(partPath, candidate); err != nil {
+			os.Remove(candidate)
+			return "", fmt.Errorf("failed to move completed download into place: %w", err)
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("failed to move completed download into place: %s and %d numbered names are taken", filePath, maxNameSuffix)
+}
+
+// claimPath reserves path for a file whose MD5 is sum, by creating it empty
+// so that concurrent downloads pick other names. It tells whether path can be
+// used, which is also the case if it already holds the same file.
+func claimPath(path, sum string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err == nil {
+		return true, f.Close()
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		return false, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	existing, err := fileMD5(path)
+	return err == nil && strings.EqualFold(existing, sum), nil
+}
@@ -0,0 +1,429 @@
+package anna
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/env"
+)
+
+var testContent = bytes.Repeat([]byte("0123456789abcdef"), 64)
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// serveContent answers with content, honouring "bytes=N-" ranges like a
+// mirror does: 206 for a range inside the file, 416 past its end.
+func serveContent(w http.ResponseWriter, r *http.Request, content []byte) {
+	spec, ranged := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ranged {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+		return
+	}
+
+	start, _ := strconv.Atoi(strings.TrimSuffix(spec, "-"))
+	if start >= len(content) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)-start))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(content[start:])
+}
+
+func newTestTransfer(url, partPath string) *transfer {
+	return &transfer{
+		newRequest: func() (*http.Request, error) {
+			return http.NewRequest("GET", url, nil)
+		},
+		partPath: partPath,
+		digest:   md5.New(),
+	}
+}
+
+func TestTransferRun(t *testing.T) {
+	tests := []struct {
+		name string
+		// part is what a previous attempt left in the partial file, if any
+		part    []byte
+		handler func(calls int, w http.ResponseWriter, r *http.Request)
+		// wantHeader tells whether the headers of a response that delivered
+		// bytes are returned
+		wantHeader bool
+	}{
+		{
+			name: "fresh download",
+			handler: func(calls int, w http.ResponseWriter, r *http.Request) {
+				serveContent(w, r, testContent)
+			},
+			wantHeader: true,
+		},
+		{
+			name: "resume with range",
+			part: testContent[:300],
+			handler: func(calls int, w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "bytes=300-" {
+					http.Error(w, "expected a range from the end of the partial file", http.StatusBadRequest)
+					return
+				}
+				serveContent(w, r, testContent)
+			},
+			wantHeader: true,
+		},
+		{
+			name: "range ignored restarts from zero",
+			part: []byte("leftover bytes of something else"),
+			handler: func(calls int, w http.ResponseWriter, r *http.Request) {
+				w.Write(testContent)
+			},
+			wantHeader: true,
+		},
+		{
+			name: "already complete",
+			part: testContent,
+			handler: func(calls int, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				serveContent(w, r, testContent)
+			},
+		},
+		{
+			name: "partial file longer than the file",
+			part: append(append([]byte{}, testContent...), "trailing garbage"...),
+			handler: func(calls int, w http.ResponseWriter, r *http.Request) {
+				serveContent(w, r, testContent)
+			},
+			wantHeader: true,
+		},
+		{
+			name: "body cut then resumed",
+			handler: func(calls int, w http.ResponseWriter, r *http.Request) {
+				if calls == 1 {
+					w.Header().Set("Content-Length", strconv.Itoa(len(testContent)))
+					w.Write(testContent[:400])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				if r.Header.Get("Range") != "bytes=400-" {
+					http.Error(w, "expected a range from the end of the partial file", http.StatusBadRequest)
+					return
+				}
+				serveContent(w, r, testContent)
+			},
+			wantHeader: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(int(calls.Add(1)), w, r)
+			}))
+			defer srv.Close()
+
+			partPath := filepath.Join(t.TempDir(), "file"+PartFileSuffix)
+			if tt.part != nil {
+				if err := os.WriteFile(partPath, tt.part, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tr := newTestTransfer(srv.URL, partPath)
+			header, size, err := tr.run(context.Background())
+			if err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if (header != nil) != tt.wantHeader {
+				t.Errorf("run() header = %v, want headers: %v", header, tt.wantHeader)
+			}
+			if size != int64(len(testContent)) {
+				t.Errorf("run() size = %d, want %d", size, len(testContent))
+			}
+
+			got, err := os.ReadFile(partPath)
+			if err != nil {
+				t.Fatalf("partial file: %v", err)
+			}
+			if !bytes.Equal(got, testContent) {
+				t.Errorf("partial file holds %d bytes that differ from the %d served", len(got), len(testContent))
+			}
+			if sum := hex.EncodeToString(tr.digest.Sum(nil)); sum != md5Hex(testContent) {
+				t.Errorf("digest = %s, want %s", sum, md5Hex(testContent))
+			}
+		})
+	}
+}
+
+func TestTransferInterrupted(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts env.Timeouts
+		// stop interrupts the transfer once the first bytes arrived, or is
+		// nil to let the total timeout do it
+		stop     func(cancel context.CancelCauseFunc)
+		wantErr  error
+		wantPart bool
+	}{
+		{
+			name:     "cancelled",
+			stop:     func(cancel context.CancelCauseFunc) { cancel(nil) },
+			wantPart: false,
+		},
+		{
+			name:     "suspended",
+			stop:     func(cancel context.CancelCauseFunc) { cancel(ErrSuspended) },
+			wantErr:  ErrSuspended,
+			wantPart: true,
+		},
+		{
+			name:     "total timeout",
+			timeouts: env.Timeouts{Total: 300 * time.Millisecond},
+			wantPart: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(testContent)))
+				w.Write(testContent[:100])
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}))
+			defer srv.Close()
+
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+
+			partPath := filepath.Join(t.TempDir(), "file"+PartFileSuffix)
+			tr := newTestTransfer(srv.URL, partPath)
+			tr.timeouts = tt.timeouts
+			tr.progress = func(done, total int64) {
+				if done > 0 && tt.stop != nil {
+					tt.stop(cancel)
+				}
+			}
+
+			_, _, err := tr.run(ctx)
+			if err == nil {
+				t.Fatal("run() succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("run() error = %v, want %v", err, tt.wantErr)
+			}
+
+			_, statErr := os.Stat(partPath)
+			if exists := statErr == nil; exists != tt.wantPart {
+				t.Errorf("partial file exists = %v, want %v (error: %v)", exists, tt.wantPart, err)
+			}
+		})
+	}
+}
+
+func TestPaperDownloadPartFile(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("ANNAS_CONFIG", "")
+	t.Setenv("ANNAS_PROFILE", "")
+
+	contents := map[string][]byte{
+		"/a": testContent,
+		"/b": bytes.Repeat([]byte("other paper "), 50),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		serveContent(w, r, contents[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	a := &Paper{DOI: "10.1000/a", Title: "Editorial", DownloadURL: srv.URL + "/a"}
+	b := &Paper{DOI: "10.1000/b", Title: "Editorial", DownloadURL: srv.URL + "/b"}
+
+	// A previous attempt left the first half of paper a
+	doiSum := md5.Sum([]byte(a.DOI))
+	partA := partFilePath(dir, "scidb-"+hex.EncodeToString(doiSum[:]))
+	if err := os.WriteFile(partA, testContent[:500], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resultB, err := b.Download(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatalf("Download(b) error = %v", err)
+	}
+	if got, _ := os.ReadFile(partA); !bytes.Equal(got, testContent[:500]) {
+		t.Fatal("downloading paper b changed the partial file of paper a")
+	}
+
+	resultA, err := a.Download(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatalf("Download(a) error = %v", err)
+	}
+
+	for _, tc := range []struct {
+		result *DownloadResult
+		name   string
+		want   []byte
+	}{
+		{resultB, "Editorial.pdf", contents["/b"]},
+		{resultA, "Editorial (2).pdf", contents["/a"]},
+	} {
+		if filepath.Base(tc.result.Path) != tc.name {
+			t.Errorf("downloaded to %s, want %s", filepath.Base(tc.result.Path), tc.name)
+		}
+		if got, _ := os.ReadFile(tc.result.Path); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s does not hold the paper downloaded to it", tc.name)
+		}
+	}
+	if _, err := os.Stat(partA); !os.IsNotExist(err) {
+		t.Errorf("partial file of paper a left behind: %v", err)
+	}
+}
+
+func TestVerifyMD5(t *testing.T) {
+	tests := []struct {
+		name        string
+		expected    string
+		wantErr     bool
+		wantCorrupt bool
+	}{
+		{name: "matching digest", expected: md5Hex(testContent)},
+		{name: "matching digest in uppercase", expected: strings.ToUpper(md5Hex(testContent))},
+		{name: "mismatching digest", expected: md5Hex([]byte("another file")), wantErr: true, wantCorrupt: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			partPath := filepath.Join(dir, "0123"+PartFileSuffix)
+			if err := os.WriteFile(partPath, testContent, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			digest := md5.New()
+			digest.Write(testContent)
+
+			sum, err := verifyMD5(digest, tt.expected, partPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyMD5() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("verifyMD5() error = %v, want %v", err, ErrChecksumMismatch)
+			}
+			if sum != md5Hex(testContent) {
+				t.Errorf("verifyMD5() = %s, want the digest of the file %s", sum, md5Hex(testContent))
+			}
+
+			_, partErr := os.Stat(partPath)
+			_, corruptErr := os.Stat(filepath.Join(dir, "0123"+CorruptFileSuffix))
+			if (partErr == nil) == tt.wantCorrupt || (corruptErr == nil) != tt.wantCorrupt {
+				t.Errorf("partial file exists = %v, quarantined file exists = %v, want the file quarantined: %v", partErr == nil, corruptErr == nil, tt.wantCorrupt)
+			}
+		})
+	}
+}
+
+func TestFinishPartFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing are the files already in the folder, by name
+		existing map[string][]byte
+		want     string
+	}{
+		{
+			name: "free name",
+			want: "Title.pdf",
+		},
+		{
+			name:     "name taken by another file",
+			existing: map[string][]byte{"Title.pdf": []byte("another file")},
+			want:     "Title (2).pdf",
+		},
+		{
+			name: "numbered names taken too",
+			existing: map[string][]byte{
+				"Title.pdf":     []byte("another file"),
+				"Title (2).pdf": []byte("yet another file"),
+			},
+			want: "Title (3).pdf",
+		},
+		{
+			name:     "same file already there",
+			existing: map[string][]byte{"Title.pdf": testContent},
+			want:     "Title.pdf",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			partPath := filepath.Join(dir, "0123"+PartFileSuffix)
+			if err := os.WriteFile(partPath, testContent, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := finishPartFile(partPath, filepath.Join(dir, "Title.pdf"), md5Hex(testContent))
+			if err != nil {
+				t.Fatalf("finishPartFile() error = %v", err)
+			}
+			if filepath.Base(got) != tt.want {
+				t.Errorf("finishPartFile() = %s, want %s", filepath.Base(got), tt.want)
+			}
+			if data, _ := os.ReadFile(got); !bytes.Equal(data, testContent) {
+				t.Errorf("%s does not hold the downloaded file", got)
+			}
+			for name, data := range tt.existing {
+				if name == tt.want {
+					continue
+				}
+				if kept, _ := os.ReadFile(filepath.Join(dir, name)); !bytes.Equal(kept, data) {
+					t.Errorf("existing file %s was changed", name)
+				}
+			}
+			if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+				t.Errorf("partial file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestHashFileMatchesOnePass(t *testing.T) {
+	partPath := filepath.Join(t.TempDir(), "file"+PartFileSuffix)
+	if err := os.WriteFile(partPath, testContent[:700], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resumed download rebuilds the digest from the partial file, then
+	// appends the rest as it arrives
+	digest := md5.New()
+	digest.Write([]byte("state of an earlier attempt"))
+	if err := hashFile(digest, partPath, 700); err != nil {
+		t.Fatalf("hashFile() error = %v", err)
+	}
+	digest.Write(testContent[700:])
+
+	if got := hex.EncodeToString(digest.Sum(nil)); got != md5Hex(testContent) {
+		t.Errorf("resumed digest = %s, want %s", got, md5Hex(testContent))
+	}
+}
@@ -0,0 +1,305 @@
+package anna
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	colly "github.com/gocolly/colly/v2"
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// MirrorCooldown is how long a mirror that failed is tried only after
+	// the ones that did not.
+	MirrorCooldown = 5 * time.Minute
+	// MirrorProbeQuery is searched for when checking a mirror, and is common
+	// enough to always have results.
+	MirrorProbeQuery = "python"
+	// mirrorProbeHash is a well-formed MD5 that matches no file.
+	mirrorProbeHash = "00000000000000000000000000000000"
+)
+
+// Elements the search scraper depends on, for telling whether a mirror still
+// serves the layout it understands.
+var searchLayoutSelectors = []string{
+	"a[href^='/md5/'].custom-a",
+	"div.max-w-full",
+	"div.text-gray-800",
+}
+
+// mirrorDownError marks failures caused by the mirror rather than by the
+// request, such as connection errors and 5xx responses, which are worth
+// retrying against the next mirror.
+type mirrorDownError struct {
+	err error
+}
+
+func (e *mirrorDownError) Error() string { return e.err.Error() }
+
+func (e *mirrorDownError) Unwrap() error { return e.err }
+
+func mirrorDown(err error) error {
+	return &mirrorDownError{err: err}
+}
+
+func isMirrorDown(err error) bool {
+	var m *mirrorDownError
+	return errors.As(err, &m)
+}
+
+// checkMirrorResponse wraps err as a mirror failure when the status code, or
+// the lack of any response, shows that the mirror itself is unavailable.
+func checkMirrorResponse(ctx context.Context, status int, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if status == 0 || status >= 500 {
+		return mirrorDown(err)
+	}
+	return err
+}
+
+// mirrorHealth records the outcome of the latest requests to a mirror.
+type mirrorHealth struct {
+	failures    int
+	lastFailure time.Time
+	lastError   string
+}
+
+// mirrorPool tracks the health of every mirror used by this process, so that
+// a mirror that just went down is not the first one tried by the next call.
+type mirrorPool struct {
+	mu     sync.Mutex
+	health map[string]*mirrorHealth
+}
+
+var mirrors = &mirrorPool{health: make(map[string]*mirrorHealth)}
+
+// order returns the mirrors to try, keeping the configured order but moving
+// the ones that failed within MirrorCooldown to the end.
+func (p *mirrorPool) order(baseURLs []string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ordered := append([]string(nil), baseURLs...)
+	coolingDown := func(baseURL string) bool {
+		h, ok := p.health[baseURL]
+		return ok && h.failures > 0 && time.Since(h.lastFailure) < MirrorCooldown
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !coolingDown(ordered[i]) && coolingDown(ordered[j])
+	})
+	return ordered
+}
+
+func (p *mirrorPool) succeeded(baseURL string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.health, baseURL)
+}
+
+func (p *mirrorPool) failed(baseURL string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.health[baseURL]
+	if !ok {
+		h = &mirrorHealth{}
+		p.health[baseURL] = h
+	}
+	h.failures++
+	h.lastFailure = time.Now()
+	h.lastError = err.Error()
+}
+
+// withMirrors runs fn against each mirror in turn until one of them is able
+// to serve the request, and returns its result along with the mirror used.
+// Errors that are not caused by the mirror are returned right away, since
+// the next mirror would answer the same.
+func withMirrors[T any](ctx context.Context, baseURLs []string, operation string, fn func(baseURL string) (T, error)) (T, string, error) {
+	l := logger.GetLogger()
+
+	var zero T
+	var lastErr error
+	for _, baseURL := range mirrors.order(baseURLs) {
+		if err := ctx.Err(); err != nil {
+			return zero, "", err
+		}
+
+		result, err := fn(baseURL)
+		if err == nil {
+			mirrors.succeeded(baseURL)
+			return result, baseURL, nil
+		}
+		if !isMirrorDown(err) {
+			return zero, baseURL, err
+		}
+
+		mirrors.failed(baseURL, err)
+		l.Warn("Mirror unavailable, trying the next one",
+			zap.String("operation", operation),
+			zap.String("mirror", baseURL),
+			zap.Error(err),
+		)
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return zero, "", errors.New("no mirrors configured")
+	}
+	return zero, "", fmt.Errorf("all mirrors failed (%d tried), last error: %w", len(baseURLs), lastErr)
+}
+
+// CheckMirrors probes every configured mirror in parallel. A mirror that
+// cannot be reached is reported in its status rather than as an error.
+func CheckMirrors(ctx context.Context) (*MirrorReport, error) {
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MirrorReport{Mirrors: make([]*MirrorStatus, len(env.AnnasBaseURLs))}
+	secretKey := env.OptionalSecretKey()
+
+	var wg sync.WaitGroup
+	for i, baseURL := range env.AnnasBaseURLs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Mirrors[i] = checkMirror(ctx, env, baseURL, secretKey)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// checkMirror loads a search page and asks the fast download API about a hash
+// that does not exist, which any working mirror answers with a JSON error.
+// Without a secret key the API is not asked, since it would only reject the
+// missing key.
+func checkMirror(ctx context.Context, env *env.Env, baseURL, secretKey string) *MirrorStatus {
+	l := logger.GetLogger()
+	status := &MirrorStatus{Mirror: baseURL}
+
+	c := colly.NewCollector(
+		colly.UserAgent(BrowserUserAgent),
+		colly.StdlibContext(ctx),
+	)
+	c.WithTransport(newTransport(env.Timeouts))
+	c.SetRequestTimeout(requestTimeout(env.Timeouts))
+
+	c.OnResponse(func(r *colly.Response) {
+		status.StatusCode = r.StatusCode
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		if r != nil {
+			status.StatusCode = r.StatusCode
+		}
+	})
+
+	// The layout is considered intact when every element the search scraper
+	// relies on is present
+	c.OnHTML("html", func(e *colly.HTMLElement) {
+		status.LayoutOK = true
+		for _, selector := range searchLayoutSelectors {
+			if e.DOM.Find(selector).Length() == 0 {
+				status.LayoutOK = false
+			}
+		}
+		status.Fingerprint = layoutFingerprint(e)
+	})
+
+	searchURL, err := buildSearchURL(baseURL, SearchOptions{Query: MirrorProbeQuery}, "book_any", 1)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	start := time.Now()
+	err = c.Visit(searchURL)
+	status.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		status.Error = err.Error()
+		mirrors.failed(baseURL, err)
+	} else {
+		status.Reachable = true
+		mirrors.succeeded(baseURL)
+	}
+
+	if secretKey != "" {
+		status.FastDownloadAPI = checkFastDownloadAPI(ctx, env, baseURL, secretKey)
+	} else {
+		status.FastDownloadAPISkipped = true
+	}
+
+	l.Info("Mirror checked",
+		zap.String("mirror", baseURL),
+		zap.Bool("reachable", status.Reachable),
+		zap.Int("statusCode", status.StatusCode),
+		zap.Int64("latencyMs", status.LatencyMS),
+		zap.Bool("fastDownloadAPI", status.FastDownloadAPI),
+		zap.Bool("fastDownloadAPISkipped", status.FastDownloadAPISkipped),
+		zap.Bool("layoutOK", status.LayoutOK),
+	)
+
+	return status
+}
+
+// checkFastDownloadAPI reports whether the fast download endpoint answers with
+// JSON. The answer itself is usually an error, since the hash is made up.
+func checkFastDownloadAPI(ctx context.Context, env *env.Env, baseURL, secretKey string) bool {
+	apiURL := fmt.Sprintf(AnnasDownloadEndpointFormat, baseURL, mirrorProbeHash, url.QueryEscape(secretKey))
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := newAPIClient(env.Timeouts).Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	var apiResp fastDownloadResponse
+	return json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&apiResp) == nil
+}
+
+// layoutFingerprint hashes the set of CSS classes used on a page. It changes
+// when the site is redesigned, but not when only the results differ.
+func layoutFingerprint(e *colly.HTMLElement) string {
+	classes := make(map[string]bool)
+	e.DOM.Find("[class]").Each(func(_ int, s *goquery.Selection) {
+		for _, class := range strings.Fields(s.AttrOr("class", "")) {
+			classes[class] = true
+		}
+	})
+
+	sorted := make([]string, 0, len(classes))
+	for class := range classes {
+		sorted = append(sorted, class)
+	}
+	sort.Strings(sorted)
+
+	sum := sha256.Sum256([]byte(strings.Join(sorted, " ")))
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,188 @@
+package anna
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultBatchConcurrency is the number of papers downloaded at the same
+	// time by DownloadPapers.
+	DefaultBatchConcurrency = 3
+	// MaxBatchConcurrency caps the concurrency asked for, to be gentle with
+	// the mirrors.
+	MaxBatchConcurrency = 8
+)
+
+// Outcomes of a paper in a batch download.
+const (
+	PaperDownloaded = "downloaded"
+	PaperNotFound   = "not_found"
+	PaperFailed     = "failed"
+	// PaperSkipped marks citations that have no DOI to look up
+	PaperSkipped = "skipped"
+)
+
+// PaperReport is the outcome of a single paper of a batch download.
+type PaperReport struct {
+	DOI    string          `json:"doi,omitempty"`
+	Title  string          `json:"title,omitempty"`
+	Status string          `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Result *DownloadResult `json:"result,omitempty"`
+}
+
+func (r *PaperReport) String() string {
+	name := r.DOI
+	if name == "" {
+		name = r.Title
+	}
+
+	switch r.Status {
+	case PaperDownloaded:
+		return fmt.Sprintf("%s: %s to %s", name, r.Status, r.Result.Path)
+	case PaperSkipped:
+		return fmt.Sprintf("%s: %s, no DOI", name, r.Status)
+	default:
+		return fmt.Sprintf("%s: %s, %s", name, r.Status, r.Error)
+	}
+}
+
+// BatchReport is the outcome of a batch download, in the order the papers
+// were given.
+type BatchReport struct {
+	Papers     []*PaperReport `json:"papers"`
+	Downloaded int            `json:"downloaded"`
+	NotFound   int            `json:"not_found"`
+	Failed     int            `json:"failed"`
+	Skipped    int            `json:"skipped"`
+}
+
+// Add appends a report and counts its outcome.
+func (b *BatchReport) Add(report *PaperReport) {
+	b.Papers = append(b.Papers, report)
+	switch report.Status {
+	case PaperDownloaded:
+		b.Downloaded++
+	case PaperNotFound:
+		b.NotFound++
+	case PaperFailed:
+		b.Failed++
+	case PaperSkipped:
+		b.Skipped++
+	}
+}
+
+func (b *BatchReport) String() string {
+	lines := make([]string, 0, len(b.Papers)+1)
+	for _, paper := range b.Papers {
+		lines = append(lines, paper.String())
+	}
+	lines = append(lines, fmt.Sprintf("%d downloaded, %d not found, %d failed, %d skipped",
+		b.Downloaded, b.NotFound, b.Failed, b.Skipped))
+	return strings.Join(lines, "\n")
+}
+
+// BatchOptions tune DownloadPapers. A nil *BatchOptions uses the defaults.
+type BatchOptions struct {
+	// Concurrency is the number of papers downloaded at the same time, at
+	// most MaxBatchConcurrency
+	Concurrency int
+	// Download is passed to every single download
+	Download *DownloadOptions
+	// OnReport, if set, is called as soon as each paper is done. It is
+	// called from several goroutines, one at a time.
+	OnReport func(report *PaperReport)
+}
+
+// DownloadPapers downloads papers by their DOIs, a few at a time, and reports
+// the outcome of each one. The papers are downloaded like DownloadPaper does.
+// A paper that cannot be downloaded does not stop the others.
+func DownloadPapers(ctx context.Context, dois []string, secretKey, folderPath string, opts *BatchOptions) *BatchReport {
+	concurrency := DefaultBatchConcurrency
+	var download *DownloadOptions
+	var onReport func(*PaperReport)
+	if opts != nil {
+		if opts.Concurrency > 0 {
+			concurrency = min(opts.Concurrency, MaxBatchConcurrency)
+		}
+		download = opts.Download
+		onReport = opts.OnReport
+	}
+
+	reports := make([]*PaperReport, len(dois))
+	var reportMutex sync.Mutex
+
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i := range dois {
+			indexes <- i
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range min(concurrency, len(dois)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				report := downloadBatchPaper(ctx, dois[i], secretKey, folderPath, download)
+
+				reportMutex.Lock()
+				reports[i] = report
+				if onReport != nil {
+					onReport(report)
+				}
+				reportMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	batch := &BatchReport{}
+	for _, report := range reports {
+		batch.Add(report)
+	}
+	return batch
+}
+
+// downloadBatchPaper downloads a single paper of DownloadPapers and reports
+// its outcome.
+func downloadBatchPaper(ctx context.Context, doi, secretKey, folderPath string, opts *DownloadOptions) *PaperReport {
+	l := logger.GetLogger()
+
+	report := &PaperReport{DOI: doi}
+	if err := ctx.Err(); err != nil {
+		report.Status = PaperFailed
+		report.Error = fmt.Sprintf("download cancelled: %s", err)
+		return report
+	}
+
+	result, err := DownloadPaper(ctx, doi, secretKey, folderPath, opts)
+	switch {
+	case err == nil:
+		report.Status = PaperDownloaded
+		report.Result = result
+	case errors.Is(err, ErrPaperNotFound):
+		report.Status = PaperNotFound
+		report.Error = err.Error()
+	default:
+		report.Status = PaperFailed
+		report.Error = err.Error()
+	}
+
+	l.Info("Paper of batch done",
+		zap.String("doi", doi),
+		zap.String("status", report.Status),
+		zap.String("error", report.Error),
+	)
+
+	return report
+}
@@ -0,0 +1,32 @@
+package anna
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestDownloadPapersCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dois := make([]string, 3*MaxBatchConcurrency)
+	for i := range dois {
+		dois[i] = fmt.Sprintf("10.1000/%d", i)
+	}
+
+	reported := 0
+	report := DownloadPapers(ctx, dois, "", t.TempDir(), &BatchOptions{
+		Concurrency: 1000,
+		OnReport:    func(*PaperReport) { reported++ },
+	})
+
+	if reported != len(dois) || report.Failed != len(dois) {
+		t.Fatalf("%d reported, %d failed, want all %d papers failed", reported, report.Failed, len(dois))
+	}
+	for i, paper := range report.Papers {
+		if paper.DOI != dois[i] {
+			t.Errorf("paper %d is %s, want %s", i, paper.DOI, dois[i])
+		}
+	}
+}
@@ -1,16 +1,47 @@
 package anna
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/env"
+)
 
 type Book struct {
-	Language  string `json:"language"`
-	Format    string `json:"format"`
-	Size      string `json:"size"`
-	Title     string `json:"title"`
-	Publisher string `json:"publisher"`
-	Authors   string `json:"authors"`
-	URL       string `json:"url"`
-	Hash      string `json:"hash"`
+	Language    string   `json:"language"`
+	Format      string   `json:"format"`
+	Size        string   `json:"size"`
+	SizeBytes   int64    `json:"size_bytes"`
+	Year        int      `json:"year,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Collections []string `json:"collections,omitempty"`
+	Title       string   `json:"title"`
+	Publisher   string   `json:"publisher"`
+	Authors     string   `json:"authors"`
+	URL         string   `json:"url"`
+	Hash        string   `json:"hash"`
+}
+
+type SearchOptions struct {
+	Query      string
+	Content    string
+	Page       int
+	Languages  []string
+	Extensions []string
+	Sources    []string
+	YearFrom   int
+	YearTo     int
+	Sort       string
+}
+
+type SearchResult struct {
+	Books   []*Book `json:"books"`
+	Page    int     `json:"page"`
+	HasMore bool    `json:"has_more"`
+	// Mirror is the Anna's Archive host that served the results
+	Mirror string `json:"mirror"`
 }
 
 type Paper struct {
@@ -23,14 +54,224 @@ type Paper struct {
 	DownloadURL string `json:"download_url"`
 	SciHubURL   string `json:"scihub_url,omitempty"`
 	PageURL     string `json:"page_url"`
+	Mirror      string `json:"mirror,omitempty"`
 }
 
 func (p *Paper) String() string {
-	return fmt.Sprintf("DOI: %s\nTitle: %s\nAuthors: %s\nJournal: %s\nSize: %s\nHash: %s\nDownload URL: %s\nSci-Hub: %s\nPage: %s",
-		p.DOI, p.Title, p.Authors, p.Journal, p.Size, p.Hash, p.DownloadURL, p.SciHubURL, p.PageURL)
+	return fmt.Sprintf("DOI: %s\nTitle: %s\nAuthors: %s\nJournal: %s\nSize: %s\nHash: %s\nDownload URL: %s\nSci-Hub: %s\nPage: %s\nMirror: %s",
+		p.DOI, p.Title, p.Authors, p.Journal, p.Size, p.Hash, p.DownloadURL, p.SciHubURL, p.PageURL, p.Mirror)
+}
+
+type BookDetails struct {
+	Hash               string         `json:"hash"`
+	Title              string         `json:"title"`
+	Authors            string         `json:"authors"`
+	Publisher          string         `json:"publisher"`
+	Edition            string         `json:"edition,omitempty"`
+	Series             string         `json:"series,omitempty"`
+	Year               int            `json:"year,omitempty"`
+	ContentType        string         `json:"content_type,omitempty"`
+	Language           string         `json:"language"`
+	Format             string         `json:"format"`
+	Size               string         `json:"size"`
+	SizeBytes          int64          `json:"size_bytes"`
+	ISBNs              []string       `json:"isbns,omitempty"`
+	Description        string         `json:"description,omitempty"`
+	CoverURL           string         `json:"cover_url,omitempty"`
+	AlternativeTitles  []string       `json:"alternative_titles,omitempty"`
+	AlternativeAuthors []string       `json:"alternative_authors,omitempty"`
+	Collections        []string       `json:"collections,omitempty"`
+	Mirrors            []string       `json:"mirrors,omitempty"`
+	OtherVersions      []*BookVersion `json:"other_versions,omitempty"`
+	URL                string         `json:"url"`
+}
+
+type BookVersion struct {
+	Hash  string `json:"hash"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+func (d *BookDetails) String() string {
+	year := ""
+	if d.Year != 0 {
+		year = fmt.Sprint(d.Year)
+	}
+
+	versions := make([]string, 0, len(d.OtherVersions))
+	for _, v := range d.OtherVersions {
+		versions = append(versions, fmt.Sprintf("%s (%s)", v.Title, v.Hash))
+	}
+
+	return fmt.Sprintf("Title: %s\nAuthors: %s\nPublisher: %s\nEdition: %s\nSeries: %s\nYear: %s\nLanguage: %s\nFormat: %s\nType: %s\nSize: %s (%d bytes)\nISBNs: %s\nAlternative titles: %s\nAlternative authors: %s\nCollections: %s\nMirrors: %s\nOther versions: %s\nCover: %s\nURL: %s\nHash: %s\nDescription: %s",
+		d.Title, d.Authors, d.Publisher, d.Edition, d.Series, year, d.Language, d.Format, d.ContentType, d.Size, d.SizeBytes,
+		strings.Join(d.ISBNs, ", "), strings.Join(d.AlternativeTitles, "; "), strings.Join(d.AlternativeAuthors, "; "),
+		strings.Join(d.Collections, ", "), strings.Join(d.Mirrors, ", "), strings.Join(versions, "; "),
+		d.CoverURL, d.URL, d.Hash, d.Description)
+}
+
+// ProgressFunc receives the number of bytes downloaded so far and the total
+// size of the file, or -1 if the server did not announce it.
+type ProgressFunc func(done, total int64)
+
+// HostLimitFunc waits until a transfer from host may start, and returns the
+// function to call once it is over. It fails only if ctx is done first.
+type HostLimitFunc func(ctx context.Context, host string) (release func(), err error)
+
+// DownloadOptions tunes a single download. A nil *DownloadOptions uses the
+// defaults.
+type DownloadOptions struct {
+	// Progress, if set, is called periodically while the file transfers
+	Progress ProgressFunc
+	// Timeouts, if set, replace the ones configured in the environment
+	Timeouts *env.Timeouts
+	// HostLimit, if set, is called before the file transfer starts, to bound
+	// the number of transfers from the same host
+	HostLimit HostLimitFunc
+}
+
+func (o *DownloadOptions) timeouts(e *env.Env) env.Timeouts {
+	if o == nil || o.Timeouts == nil {
+		return e.Timeouts
+	}
+	return *o.Timeouts
+}
+
+func (o *DownloadOptions) progress() ProgressFunc {
+	if o == nil {
+		return nil
+	}
+	return o.Progress
+}
+
+func (o *DownloadOptions) hostLimit() HostLimitFunc {
+	if o == nil {
+		return nil
+	}
+	return o.HostLimit
+}
+
+// Sources a file can be downloaded from.
+const (
+	SourceFastDownload = "fast_download"
+	SourceSciDB        = "scidb"
+)
+
+type DownloadResult struct {
+	Path     string `json:"path"`
+	Bytes    int64  `json:"bytes"`
+	MD5      string `json:"md5"`
+	Verified bool   `json:"verified"`
+	// Hash is the MD5 of the record the file was downloaded for, which
+	// differs from MD5 when SciDB served another copy of a paper
+	Hash    string `json:"hash,omitempty"`
+	DOI     string `json:"doi,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Authors string `json:"authors,omitempty"`
+	// Source is SourceFastDownload or SourceSciDB
+	Source string `json:"source,omitempty"`
+	// Mirror is the Anna's Archive host the download was requested from
+	Mirror string `json:"mirror,omitempty"`
+	// DownloadsLeft is the remaining fast download quota, when known
+	DownloadsLeft *int `json:"downloads_left,omitempty"`
+}
+
+func (r *DownloadResult) String() string {
+	verification := "not verified"
+	if r.Verified {
+		verification = "verified"
+	}
+	s := fmt.Sprintf("Path: %s\nSize: %d bytes\nMD5: %s (%s)", r.Path, r.Bytes, r.MD5, verification)
+	if r.Mirror != "" {
+		s += "\nMirror: " + r.Mirror
+	}
+	if r.DownloadsLeft != nil {
+		s += fmt.Sprintf("\nFast downloads left today: %d", *r.DownloadsLeft)
+	}
+	return s
+}
+
+// metaInformation holds what can be parsed from the "·" separated meta line
+// shown for every file.
+type metaInformation struct {
+	Language    string
+	Format      string
+	Size        string
+	SizeBytes   int64
+	Year        int
+	ContentType string
+	Collections []string
 }
 
 type fastDownloadResponse struct {
-	DownloadURL string `json:"download_url"`
-	Error       string `json:"error"`
+	DownloadURL string                   `json:"download_url"`
+	Error       string                   `json:"error"`
+	AccountInfo *fastDownloadAccountInfo `json:"account_fast_download_info"`
+}
+
+// fastDownloadAccountInfo is the quota of the account, sent along with every
+// download URL.
+type fastDownloadAccountInfo struct {
+	DownloadsLeft          int      `json:"downloads_left"`
+	DownloadsPerDay        int      `json:"downloads_per_day"`
+	RecentlyDownloadedMD5s []string `json:"recently_downloaded_md5s"`
+}
+
+// AccountStatus is the fast download quota of the account.
+type AccountStatus struct {
+	// Known is false until a fast download has revealed the quota. It says
+	// nothing about whether the secret key is valid.
+	Known           bool `json:"known"`
+	DownloadsLeft   int  `json:"downloads_left"`
+	DownloadsPerDay int  `json:"downloads_per_day"`
+	// RecentlyDownloaded are the files that can be downloaded again without
+	// using up the quota
+	RecentlyDownloaded []string  `json:"recently_downloaded_md5s,omitempty"`
+	CheckedAt          time.Time `json:"checked_at,omitempty"`
+	// Live is false when the quota comes from the last download rather than
+	// from the API
+	Live   bool   `json:"live"`
+	Mirror string `json:"mirror,omitempty"`
+}
+
+func (s *AccountStatus) String() string {
+	if !s.Known {
+		return "The fast download quota is unknown. The API reports it only along with a download, so it will be known after the next fast download."
+	}
+
+	text := fmt.Sprintf("Fast downloads left: %d of %d per day", s.DownloadsLeft, s.DownloadsPerDay)
+	if !s.Live {
+		text += fmt.Sprintf(" (as of the last download, %s)", s.CheckedAt.Format(time.RFC3339))
+	}
+	text += fmt.Sprintf("\nRecently downloaded files, which can be downloaded again for free: %d", len(s.RecentlyDownloaded))
+	if s.DownloadsLeft <= 1 {
+		text += "\nWarning: the daily fast download quota is almost used up."
+	}
+	return text
+}
+
+// MirrorStatus is the outcome of probing a single mirror.
+type MirrorStatus struct {
+	Mirror string `json:"mirror"`
+	// Reachable tells whether the search page loaded
+	Reachable  bool  `json:"reachable"`
+	StatusCode int   `json:"status_code,omitempty"`
+	LatencyMS  int64 `json:"latency_ms"`
+	// FastDownloadAPI tells whether the fast download endpoint answers with
+	// JSON
+	FastDownloadAPI bool `json:"fast_download_api"`
+	// FastDownloadAPISkipped tells that the endpoint was not checked, since
+	// no secret key is set
+	FastDownloadAPISkipped bool `json:"fast_download_api_skipped,omitempty"`
+	// LayoutOK tells whether the search page has the elements the scraper
+	// relies on
+	LayoutOK bool `json:"layout_ok"`
+	// Fingerprint identifies the page layout, so that mirrors serving
+	// different versions of the site can be told apart
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type MirrorReport struct {
+	Mirrors []*MirrorStatus `json:"mirrors"`
 }
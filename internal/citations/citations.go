@@ -0,0 +1,253 @@
+package citations
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// DOIs as they appear in text, links and bibliography fields. The suffix
+	// may contain almost anything, so it ends at whitespace, quotes and
+	// braces, and trailing punctuation is trimmed afterwards.
+	doiRegex = regexp.MustCompile(`10\.\d{4,9}/[^\s"'<>{}]+`)
+
+	// Start of a BibTeX entry, e.g. "@article{smith2020,"
+	bibtexEntryRegex = regexp.MustCompile(`@(\w+)\s*[{(]\s*([^,\s]*)\s*,`)
+
+	// Name of a BibTeX field, followed by its value
+	bibtexFieldRegex = regexp.MustCompile(`(?i)\b(\w+)\s*=\s*`)
+
+	// An RIS line, e.g. "DO  - 10.1038/nature12345"
+	risLineRegex = regexp.MustCompile(`^([A-Z][A-Z0-9])  -\s?(.*)$`)
+)
+
+// Citation is a reference to a paper found in a bibliography.
+type Citation struct {
+	DOI   string `json:"doi,omitempty"`
+	Title string `json:"title,omitempty"`
+	// Key is the citation key of a BibTeX entry or the ID of an RIS record
+	Key string `json:"key,omitempty"`
+}
+
+// Parse extracts the citations of a BibTeX bibliography, of an RIS export,
+// or of any other text, in which case every DOI found is a citation.
+// Citations are deduplicated by DOI, and the ones without a DOI are kept so
+// that they can be reported.
+func Parse(text string) []Citation {
+	// Exports saved on Windows may start with a byte order mark
+	text = strings.TrimPrefix(text, "\ufeff")
+
+	var citations []Citation
+	switch {
+	case bibtexEntryRegex.MatchString(text):
+		citations = parseBibTeX(text)
+	case isRIS(text):
+		citations = parseRIS(text)
+	default:
+		citations = parseText(text)
+	}
+	return Dedupe(citations)
+}
+
+// NormalizeDOI returns the DOI contained in s, such as a bare DOI, a
+// "doi:" reference or a doi.org link, or an empty string if there is none.
+func NormalizeDOI(s string) string {
+	doi := doiRegex.FindString(s)
+	if doi == "" {
+		return ""
+	}
+
+	// Sentences and lists end with punctuation that is not part of the DOI,
+	// but parentheses are when they are balanced, e.g. 10.1016/0002-9610(82)90045-X
+	for {
+		trimmed := strings.TrimRight(doi, ".,;:")
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, "(") < strings.Count(trimmed, ")") {
+			trimmed = strings.TrimSuffix(trimmed, ")")
+		}
+		if trimmed == doi {
+			return doi
+		}
+		doi = trimmed
+	}
+}
+
+func parseText(text string) []Citation {
+	var citations []Citation
+	for _, match := range doiRegex.FindAllString(text, -1) {
+		if doi := NormalizeDOI(match); doi != "" {
+			citations = append(citations, Citation{DOI: doi})
+		}
+	}
+	return citations
+}
+
+func parseBibTeX(text string) []Citation {
+	var citations []Citation
+
+	entries := bibtexEntryRegex.FindAllStringSubmatchIndex(text, -1)
+	for i, entry := range entries {
+		kind := strings.ToLower(text[entry[2]:entry[3]])
+		if kind == "comment" || kind == "string" || kind == "preamble" {
+			continue
+		}
+
+		end := len(text)
+		if i+1 < len(entries) {
+			end = entries[i+1][0]
+		}
+		fields := bibtexFields(text[entry[1]:end])
+
+		citation := Citation{
+			Key:   text[entry[4]:entry[5]],
+			Title: cleanBibTeX(fields["title"]),
+			DOI:   NormalizeDOI(fields["doi"]),
+		}
+		if citation.DOI == "" {
+			citation.DOI = NormalizeDOI(fields["url"])
+		}
+		citations = append(citations, citation)
+	}
+
+	return citations
+}
+
+// bibtexFields returns the fields of an entry body, keyed by their lowercase
+// name. The fields are read one after the other, so that text inside a
+// value, such as "x = y" in an abstract, is not taken for a field.
+func bibtexFields(body string) map[string]string {
+	fields := make(map[string]string)
+
+	for {
+		match := bibtexFieldRegex.FindStringSubmatchIndex(body)
+		if match == nil {
+			return fields
+		}
+		name := strings.ToLower(body[match[2]:match[3]])
+
+		value, rest, ok := bibtexValue(body[match[1]:])
+		if _, seen := fields[name]; ok && !seen {
+			fields[name] = value
+		}
+		body = rest
+	}
+}
+
+// bibtexValue splits s, which starts with a field value, into the value and
+// what follows it. Values may be delimited by braces, which nest, or by
+// quotes, which do not end the value inside braces. A value whose braces are
+// not balanced is skipped, and the fields after it are still read.
+func bibtexValue(s string) (value, rest string, ok bool) {
+	switch {
+	case strings.HasPrefix(s, "{"):
+		depth := 0
+		for i, r := range s {
+			if r == '{' {
+				depth++
+			} else if r == '}' {
+				depth--
+				if depth == 0 {
+					return s[1:i], s[i+1:], true
+				}
+			}
+		}
+		return "", s[1:], false
+	case strings.HasPrefix(s, `"`):
+		depth := 0
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+			case '"':
+				if depth == 0 {
+					return s[1:i], s[i+1:], true
+				}
+			}
+		}
+		return "", s[1:], false
+	default:
+		value, rest, _ := strings.Cut(s, ",")
+		return strings.TrimSpace(strings.TrimRight(value, "})\n")), rest, true
+	}
+}
+
+// cleanBibTeX removes the braces protecting capitalization and collapses
+// whitespace.
+func cleanBibTeX(value string) string {
+	value = strings.NewReplacer("{", "", "}", "").Replace(value)
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func isRIS(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "TY  -") {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRIS(text string) []Citation {
+	var citations []Citation
+	var current *Citation
+	var url string
+
+	for _, line := range strings.Split(text, "\n") {
+		match := risLineRegex.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+		tag, value := match[1], strings.TrimSpace(match[2])
+
+		switch tag {
+		case "TY":
+			current = &Citation{}
+			url = ""
+		case "ER":
+			if current != nil {
+				if current.DOI == "" {
+					current.DOI = NormalizeDOI(url)
+				}
+				citations = append(citations, *current)
+			}
+			current = nil
+		}
+		if current == nil {
+			continue
+		}
+
+		switch tag {
+		case "DO":
+			current.DOI = NormalizeDOI(value)
+		case "TI", "T1":
+			if current.Title == "" {
+				current.Title = value
+			}
+		case "ID":
+			current.Key = value
+		case "UR":
+			if url == "" {
+				url = value
+			}
+		}
+	}
+
+	return citations
+}
+
+// Dedupe drops the citations whose DOI already appeared, ignoring case as
+// DOIs do.
+func Dedupe(citations []Citation) []Citation {
+	seen := make(map[string]bool)
+	unique := citations[:0]
+	for _, citation := range citations {
+		key := strings.ToLower(citation.DOI)
+		if key != "" && seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, citation)
+	}
+	return unique
+}
@@ -0,0 +1,124 @@
+package citations
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []Citation
+	}{
+		{
+			name: "bibtex with nested braces",
+			text: `@article{smith2020,
+  title = {The {DNA} of {{Deep}} Learning},
+  author = {Smith, John and Doe, Jane},
+  doi = {10.1038/nature12345},
+}`,
+			want: []Citation{{Key: "smith2020", Title: "The DNA of Deep Learning", DOI: "10.1038/nature12345"}},
+		},
+		{
+			name: "bibtex with quoted values",
+			text: `@inproceedings{doe2019,
+  title = "Graphs {"}and{"} trees",
+  doi = "10.1145/3292500.3330701",
+  year = 2019
+}`,
+			want: []Citation{{Key: "doe2019", Title: `Graphs "and" trees`, DOI: "10.1145/3292500.3330701"}},
+		},
+		{
+			name: "bibtex fields inside values",
+			text: `@article{lee2021,
+  abstract = {We show that doi = 10.9999/not-this-one, and url = x.},
+  title = {Real title},
+  doi = {10.1000/real},
+}`,
+			want: []Citation{{Key: "lee2021", Title: "Real title", DOI: "10.1000/real"}},
+		},
+		{
+			name: "bibtex with url only",
+			text: `@misc{web,
+  title = {Online},
+  url = {https://doi.org/10.5281/zenodo.1234567},
+}`,
+			want: []Citation{{Key: "web", Title: "Online", DOI: "10.5281/zenodo.1234567"}},
+		},
+		{
+			name: "bibtex with unbalanced braces",
+			text: `@article{bad,
+  title = {Broken {title,
+  doi = {10.1000/after},
+}`,
+			want: []Citation{{Key: "bad", DOI: "10.1000/after"}},
+		},
+		{
+			name: "bibtex skips comments and keeps entries without doi",
+			text: `@comment{jabref-meta: x,}
+@book{nodoi, title = {No DOI}, year = 1999}
+@article{dup1, doi = {10.1000/ABC}}
+@article{dup2, doi = {10.1000/abc}}`,
+			want: []Citation{{Key: "nodoi", Title: "No DOI"}, {Key: "dup1", DOI: "10.1000/ABC"}},
+		},
+		{
+			name: "ris with crlf",
+			text: "\ufeffTY  - JOUR\r\nID  - r1\r\nTI  - First paper\r\nDO  - 10.1038/nature12345\r\nER  - \r\nTY  - JOUR\r\nT1  - Second paper\r\nUR  - https://doi.org/10.1126/science.1234567\r\nER  -\r\n",
+			want: []Citation{
+				{Key: "r1", Title: "First paper", DOI: "10.1038/nature12345"},
+				{Title: "Second paper", DOI: "10.1126/science.1234567"},
+			},
+		},
+		{
+			name: "plain text",
+			text: "See doi:10.1038/nature12345, and https://doi.org/10.1016/0002-9610(82)90045-X (2nd).\n10.1038/NATURE12345.",
+			want: []Citation{{DOI: "10.1038/nature12345"}, {DOI: "10.1016/0002-9610(82)90045-X"}},
+		},
+		{
+			name: "nothing",
+			text: "no references here",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.text)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDOI(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"10.1038/nature12345", "10.1038/nature12345"},
+		{"doi:10.1038/nature12345", "10.1038/nature12345"},
+		{"https://doi.org/10.1038/nature12345", "10.1038/nature12345"},
+		{"10.1038/nature12345.", "10.1038/nature12345"},
+		{"10.1038/nature12345;,:", "10.1038/nature12345"},
+		{"(10.1038/nature12345)", "10.1038/nature12345"},
+		{"(see 10.1038/nature12345).", "10.1038/nature12345"},
+		{"10.1016/0002-9610(82)90045-X", "10.1016/0002-9610(82)90045-X"},
+		{"10.1016/0002-9610(82)90045-X.", "10.1016/0002-9610(82)90045-X"},
+		{"(10.1016/0002-9610(82)90045-X)", "10.1016/0002-9610(82)90045-X"},
+		{`"10.1000/quoted"`, "10.1000/quoted"},
+		{"10.1000/a.b.c", "10.1000/a.b.c"},
+		{"10.12/short-prefix", ""},
+		{"no doi", ""},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeDOI(tt.in); got != tt.want {
+			t.Errorf("NormalizeDOI(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
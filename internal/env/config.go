@@ -0,0 +1,295 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	ConfigDirName  = "annas-mcp"
+	ConfigFileName = "config.toml"
+)
+
+// Config is the content of the config file. The settings at the top level
+// apply to every profile, which can override any of them:
+//
+//	download_path = "/home/me/Books"
+//	default_profile = "personal"
+//
+//	[profiles.personal]
+//	secret_key_command = "pass show anna"
+//
+//	[profiles.lab]
+//	secret_key_file = "/srv/lab/anna.key"
+//	download_path = "/srv/lab/papers"
+//	mirrors = ["annas-archive.pm", "annas-archive.li"]
+//	filename_template = "{authors} - {title}"
+//
+//	[profiles.lab.search]
+//	content = "journal"
+//	languages = ["en"]
+//
+//	[users.alice]
+//	token = "3f7c1e..."
+//	profile = "lab"
+type Config struct {
+	Profile
+	DefaultProfile string              `toml:"default_profile"`
+	Profiles       map[string]*Profile `toml:"profiles"`
+	// Users are the clients allowed to use an MCP server shared over HTTP
+	Users map[string]*User `toml:"users"`
+}
+
+// User is a client of a shared MCP server. It authenticates with Token, and
+// searches and downloads with the settings of Profile, such as its own secret
+// key and download path.
+type User struct {
+	Token   string `toml:"token"`
+	Profile string `toml:"profile"`
+}
+
+// Profile holds the settings of one account or use case. Empty fields are
+// left to the next source, so that environment variables override profiles
+// and profiles override the top level of the file.
+type Profile struct {
+	SecretKey        string         `toml:"secret_key"`
+	SecretKeyFile    string         `toml:"secret_key_file"`
+	SecretKeyCommand string         `toml:"secret_key_command"`
+	DownloadPath     string         `toml:"download_path"`
+	Mirrors          []string       `toml:"mirrors"`
+	Timeouts         ConfigTimeouts `toml:"timeouts"`
+	FilenameTemplate string         `toml:"filename_template"`
+	Search           SearchDefaults `toml:"search"`
+}
+
+// ConfigTimeouts are the timeouts as written in the file, such as "90s".
+type ConfigTimeouts struct {
+	Connect        *time.Duration `toml:"connect"`
+	ResponseHeader *time.Duration `toml:"response_header"`
+	Idle           *time.Duration `toml:"idle"`
+	Total          *time.Duration `toml:"total"`
+}
+
+// SearchDefaults are the filters applied to searches that do not set their
+// own.
+type SearchDefaults struct {
+	Content    string   `toml:"content" json:"content,omitempty"`
+	Languages  []string `toml:"languages" json:"languages,omitempty"`
+	Extensions []string `toml:"extensions" json:"extensions,omitempty"`
+	Sources    []string `toml:"sources" json:"sources,omitempty"`
+	YearFrom   int      `toml:"year_from" json:"year_from,omitempty"`
+	YearTo     int      `toml:"year_to" json:"year_to,omitempty"`
+	Sort       string   `toml:"sort" json:"sort,omitempty"`
+}
+
+var (
+	profileMutex    sync.Mutex
+	selectedProfile string
+
+	// Characters of profile names that are kept out of file names
+	unsafeProfileChars = regexp.MustCompile(`[^\w.-]`)
+)
+
+// SetProfile selects the profile used by GetEnv, taking precedence over
+// ANNAS_PROFILE and the default profile of the config file.
+func SetProfile(name string) {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+
+	selectedProfile = name
+}
+
+func profileName(config *Config) string {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+
+	if selectedProfile != "" {
+		return selectedProfile
+	}
+	if name := os.Getenv("ANNAS_PROFILE"); name != "" {
+		return name
+	}
+	return config.DefaultProfile
+}
+
+// ConfigPath returns the location of the config file, which is ANNAS_CONFIG
+// if set and config.toml in the user's config directory (XDG_CONFIG_HOME on
+// Linux) otherwise.
+func ConfigPath() (string, error) {
+	if path := os.Getenv("ANNAS_CONFIG"); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the config directory: %w", err)
+	}
+	return filepath.Join(dir, ConfigDirName, ConfigFileName), nil
+}
+
+// StatePath returns the file name+ext in the user's cache directory, where
+// state kept between runs is stored separately for every profile.
+func (e *Env) StatePath(name, ext string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the cache directory: %w", err)
+	}
+
+	if e.Profile != "" {
+		name += "-" + unsafeProfileChars.ReplaceAllString(e.Profile, "_")
+	}
+	return filepath.Join(dir, ConfigDirName, name+ext), nil
+}
+
+// loadConfig reads the config file. A missing file is the same as an empty
+// one, unless it was named explicitly through ANNAS_CONFIG.
+func loadConfig() (*Config, string, error) {
+	path, err := ConfigPath()
+	if err != nil {
+		return nil, "", err
+	}
+
+	config := &Config{}
+	if _, err := toml.DecodeFile(path, config); err != nil {
+		if errors.Is(err, fs.ErrNotExist) && os.Getenv("ANNAS_CONFIG") == "" {
+			return config, path, nil
+		}
+		return nil, path, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	return config, path, nil
+}
+
+// LoadUsers returns the users of the config file, by name.
+func LoadUsers() (map[string]*User, error) {
+	config, path, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string)
+	for name, user := range config.Users {
+		if user.Token == "" {
+			return nil, fmt.Errorf("user %q has no token in %s", name, path)
+		}
+		if other, ok := tokens[user.Token]; ok {
+			return nil, fmt.Errorf("users %q and %q have the same token in %s", other, name, path)
+		}
+		tokens[user.Token] = name
+
+		if user.Profile == "" {
+			return nil, fmt.Errorf("user %q has no profile in %s", name, path)
+		}
+		if _, ok := config.Profiles[user.Profile]; !ok {
+			return nil, fmt.Errorf("profile %q of user %q is not defined in %s", user.Profile, name, path)
+		}
+	}
+
+	return config.Users, nil
+}
+
+// loadProfile returns the name and settings of the named profile, or of the
+// selected one if name is empty, merged over the top level settings of the
+// config file.
+func loadProfile(name string) (string, *Profile, error) {
+	config, path, err := loadConfig()
+	if err != nil {
+		return "", nil, err
+	}
+
+	profile := config.Profile
+	if name == "" {
+		name = profileName(config)
+	}
+	if name == "" {
+		return "", &profile, nil
+	}
+
+	named, ok := config.Profiles[name]
+	if !ok {
+		return "", nil, fmt.Errorf("profile %q is not defined in %s", name, path)
+	}
+	profile.merge(named)
+
+	return name, &profile, nil
+}
+
+// merge overrides the settings of p with the ones set in other.
+func (p *Profile) merge(other *Profile) {
+	// The secret key settings are alternatives, so a profile setting any of
+	// them replaces all of the inherited ones
+	if other.SecretKey != "" || other.SecretKeyFile != "" || other.SecretKeyCommand != "" {
+		p.SecretKey = other.SecretKey
+		p.SecretKeyFile = other.SecretKeyFile
+		p.SecretKeyCommand = other.SecretKeyCommand
+	}
+	if other.DownloadPath != "" {
+		p.DownloadPath = other.DownloadPath
+	}
+	if len(other.Mirrors) > 0 {
+		p.Mirrors = other.Mirrors
+	}
+	if other.FilenameTemplate != "" {
+		p.FilenameTemplate = other.FilenameTemplate
+	}
+
+	if other.Timeouts.Connect != nil {
+		p.Timeouts.Connect = other.Timeouts.Connect
+	}
+	if other.Timeouts.ResponseHeader != nil {
+		p.Timeouts.ResponseHeader = other.Timeouts.ResponseHeader
+	}
+	if other.Timeouts.Idle != nil {
+		p.Timeouts.Idle = other.Timeouts.Idle
+	}
+	if other.Timeouts.Total != nil {
+		p.Timeouts.Total = other.Timeouts.Total
+	}
+
+	if other.Search.Content != "" {
+		p.Search.Content = other.Search.Content
+	}
+	if len(other.Search.Languages) > 0 {
+		p.Search.Languages = other.Search.Languages
+	}
+	if len(other.Search.Extensions) > 0 {
+		p.Search.Extensions = other.Search.Extensions
+	}
+	if len(other.Search.Sources) > 0 {
+		p.Search.Sources = other.Search.Sources
+	}
+	if other.Search.YearFrom != 0 {
+		p.Search.YearFrom = other.Search.YearFrom
+	}
+	if other.Search.YearTo != 0 {
+		p.Search.YearTo = other.Search.YearTo
+	}
+	if other.Search.Sort != "" {
+		p.Search.Sort = other.Search.Sort
+	}
+}
+
+// apply overrides the timeouts in t with the ones set in the file.
+func (c ConfigTimeouts) apply(t Timeouts) Timeouts {
+	if c.Connect != nil {
+		t.Connect = *c.Connect
+	}
+	if c.ResponseHeader != nil {
+		t.ResponseHeader = *c.ResponseHeader
+	}
+	if c.Idle != nil {
+		t.Idle = *c.Idle
+	}
+	if c.Total != nil {
+		t.Total = *c.Total
+	}
+	return t
+}
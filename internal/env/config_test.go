@@ -0,0 +1,267 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+download_path = "/base/downloads"
+secret_key_file = "/base/key"
+filename_template = "{title}"
+default_profile = "personal"
+
+[timeouts]
+idle = "2m"
+total = "1h"
+
+[search]
+languages = ["en"]
+sort = "newest"
+
+[profiles.personal]
+secret_key_command = "pass show anna"
+
+[profiles.lab]
+secret_key = "lab-key"
+download_path = "/srv/lab"
+mirrors = ["lab.example"]
+filename_template = "{authors} - {title}"
+
+[profiles.lab.timeouts]
+idle = "5m"
+
+[profiles.lab.search]
+extensions = ["pdf"]
+sort = "oldest"
+`
+
+// setupConfig writes config to a temporary config file, and clears the
+// environment variables and profile selection that would override it.
+func setupConfig(t *testing.T, config string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ANNAS_CONFIG", path)
+	for _, name := range []string{
+		"ANNAS_PROFILE", "ANNAS_DOWNLOAD_PATH", "ANNAS_BASE_URL", "ANNAS_BASE_URLS",
+		"ANNAS_FILENAME_TEMPLATE", "ANNAS_CONNECT_TIMEOUT", "ANNAS_RESPONSE_HEADER_TIMEOUT",
+		"ANNAS_IDLE_TIMEOUT", "ANNAS_TOTAL_TIMEOUT",
+	} {
+		t.Setenv(name, "")
+	}
+	SetProfile("")
+	t.Cleanup(func() { SetProfile("") })
+}
+
+func duration(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestLoadProfile(t *testing.T) {
+	base := Profile{
+		DownloadPath:     "/base/downloads",
+		SecretKeyFile:    "/base/key",
+		FilenameTemplate: "{title}",
+		Timeouts:         ConfigTimeouts{Idle: duration(2 * time.Minute), Total: duration(time.Hour)},
+		Search:           SearchDefaults{Languages: []string{"en"}, Sort: "newest"},
+	}
+
+	personal := base
+	personal.SecretKeyFile = ""
+	personal.SecretKeyCommand = "pass show anna"
+
+	lab := base
+	lab.SecretKeyFile = ""
+	lab.SecretKey = "lab-key"
+	lab.DownloadPath = "/srv/lab"
+	lab.Mirrors = []string{"lab.example"}
+	lab.FilenameTemplate = "{authors} - {title}"
+	lab.Timeouts = ConfigTimeouts{Idle: duration(5 * time.Minute), Total: duration(time.Hour)}
+	lab.Search = SearchDefaults{Languages: []string{"en"}, Extensions: []string{"pdf"}, Sort: "oldest"}
+
+	tests := []struct {
+		name        string
+		config      string
+		arg         string
+		environ     string
+		selected    string
+		wantName    string
+		wantProfile Profile
+		wantErr     bool
+	}{
+		{name: "default profile", config: testConfig, wantName: "personal", wantProfile: personal},
+		{name: "environment over default", config: testConfig, environ: "lab", wantName: "lab", wantProfile: lab},
+		{name: "flag over environment", config: testConfig, environ: "personal", selected: "lab", wantName: "lab", wantProfile: lab},
+		{name: "named over selected", config: testConfig, arg: "lab", selected: "personal", wantName: "lab", wantProfile: lab},
+		{name: "unknown profile", config: testConfig, arg: "missing", wantErr: true},
+		{name: "no profiles", config: `download_path = "/base/downloads"`, wantProfile: Profile{DownloadPath: "/base/downloads"}},
+		{name: "invalid file", config: `download_path = `, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.config)
+			t.Setenv("ANNAS_PROFILE", tt.environ)
+			SetProfile(tt.selected)
+
+			name, profile, err := loadProfile(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if name != tt.wantName {
+				t.Errorf("loadProfile() name = %q, want %q", name, tt.wantName)
+			}
+			if !reflect.DeepEqual(*profile, tt.wantProfile) {
+				t.Errorf("loadProfile() = %+v, want %+v", *profile, tt.wantProfile)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	setupConfig(t, "")
+
+	// A config file named explicitly must exist
+	t.Setenv("ANNAS_CONFIG", filepath.Join(t.TempDir(), "missing.toml"))
+	if _, _, err := loadProfile(""); err == nil {
+		t.Error("loadProfile() succeeded without the file named by ANNAS_CONFIG")
+	}
+
+	// The default one is optional
+	t.Setenv("ANNAS_CONFIG", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if _, profile, err := loadProfile(""); err != nil || !reflect.DeepEqual(*profile, Profile{}) {
+		t.Errorf("loadProfile() without a config file = %+v, %v", profile, err)
+	}
+}
+
+func TestGetEnvPrecedence(t *testing.T) {
+	type settings struct {
+		DownloadPath     string
+		AnnasBaseURLs    []string
+		FilenameTemplate string
+		Timeouts         Timeouts
+	}
+
+	tests := []struct {
+		name    string
+		environ map[string]string
+		fromEnv bool
+		want    settings
+	}{
+		{
+			name:    "profile over base config",
+			fromEnv: true,
+			want: settings{
+				DownloadPath:     "/srv/lab",
+				AnnasBaseURLs:    []string{"lab.example"},
+				FilenameTemplate: "{authors} - {title}",
+				Timeouts: Timeouts{
+					Connect:        DefaultConnectTimeout,
+					ResponseHeader: DefaultResponseHeaderTimeout,
+					Idle:           5 * time.Minute,
+					Total:          time.Hour,
+				},
+			},
+		},
+		{
+			name: "environment over profile",
+			environ: map[string]string{
+				"ANNAS_DOWNLOAD_PATH":     "/env/downloads",
+				"ANNAS_BASE_URLS":         "https://env.example/, other.example",
+				"ANNAS_FILENAME_TEMPLATE": "{doi}",
+				"ANNAS_IDLE_TIMEOUT":      "30",
+				"ANNAS_CONNECT_TIMEOUT":   "5s",
+			},
+			fromEnv: true,
+			want: settings{
+				DownloadPath:     "/env/downloads",
+				AnnasBaseURLs:    []string{"env.example", "other.example"},
+				FilenameTemplate: "{doi}",
+				Timeouts: Timeouts{
+					Connect:        5 * time.Second,
+					ResponseHeader: DefaultResponseHeaderTimeout,
+					Idle:           30 * time.Second,
+					Total:          time.Hour,
+				},
+			},
+		},
+		{
+			name:    "download path of the environment ignored for users",
+			environ: map[string]string{"ANNAS_DOWNLOAD_PATH": "/env/downloads"},
+			want: settings{
+				DownloadPath:     "/srv/lab",
+				AnnasBaseURLs:    []string{"lab.example"},
+				FilenameTemplate: "{authors} - {title}",
+				Timeouts: Timeouts{
+					Connect:        DefaultConnectTimeout,
+					ResponseHeader: DefaultResponseHeaderTimeout,
+					Idle:           5 * time.Minute,
+					Total:          time.Hour,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, testConfig)
+			for name, value := range tt.environ {
+				t.Setenv(name, value)
+			}
+
+			e, err := getEnv("lab", tt.fromEnv)
+			if err != nil {
+				t.Fatalf("getEnv() error = %v", err)
+			}
+			if e.Profile != "lab" {
+				t.Errorf("Profile = %q, want %q", e.Profile, "lab")
+			}
+			if e.DownloadPath != tt.want.DownloadPath {
+				t.Errorf("DownloadPath = %q, want %q", e.DownloadPath, tt.want.DownloadPath)
+			}
+			if !reflect.DeepEqual(e.AnnasBaseURLs, tt.want.AnnasBaseURLs) || e.AnnasBaseURL != tt.want.AnnasBaseURLs[0] {
+				t.Errorf("AnnasBaseURLs = %q, want %q", e.AnnasBaseURLs, tt.want.AnnasBaseURLs)
+			}
+			if e.FilenameTemplate != tt.want.FilenameTemplate {
+				t.Errorf("FilenameTemplate = %q, want %q", e.FilenameTemplate, tt.want.FilenameTemplate)
+			}
+			if e.Timeouts != tt.want.Timeouts {
+				t.Errorf("Timeouts = %+v, want %+v", e.Timeouts, tt.want.Timeouts)
+			}
+		})
+	}
+}
+
+func TestGetEnvInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		environ map[string]string
+	}{
+		{name: "relative download path", config: `download_path = "downloads"`},
+		{name: "negative timeout", environ: map[string]string{"ANNAS_IDLE_TIMEOUT": "-5s"}},
+		{name: "malformed timeout", environ: map[string]string{"ANNAS_TOTAL_TIMEOUT": "soon"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.config)
+			for name, value := range tt.environ {
+				t.Setenv(name, value)
+			}
+			if _, err := GetEnv(); err == nil {
+				t.Error("GetEnv() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -1,54 +1,283 @@
 package env
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/iosifache/annas-mcp/internal/logger"
 	"go.uber.org/zap"
 )
 
-const DefaultAnnasBaseURL = "annas-archive.li"
+const (
+	DefaultAnnasBaseURL          = "annas-archive.li"
+	DefaultConnectTimeout        = 15 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+	DefaultIdleTimeout           = 60 * time.Second
+	DefaultTotalTimeout          = 0
+)
+
+// DefaultAnnasBaseURLs are the mirrors tried, in order, when none are
+// configured.
+var DefaultAnnasBaseURLs = []string{DefaultAnnasBaseURL, "annas-archive.pm", "annas-archive.in"}
 
 type Env struct {
+	// SecretKey may be resolved lazily, so read it through ResolveSecretKey
 	SecretKey    string `json:"secret"`
 	DownloadPath string `json:"download_path"`
+	// Profile is the config file profile in use, if any
+	Profile string `json:"profile,omitempty"`
+	// User is the MCP server user the settings belong to, if any
+	User string `json:"user,omitempty"`
+	// AnnasBaseURL is the preferred mirror, the first of AnnasBaseURLs
 	AnnasBaseURL string `json:"annas_base_url"`
+	// AnnasBaseURLs are the mirrors to fail over between, in order of
+	// preference
+	AnnasBaseURLs []string `json:"annas_base_urls"`
+	Timeouts      Timeouts `json:"timeouts"`
+	// FilenameTemplate names downloaded files, e.g. "{authors} - {title}"
+	FilenameTemplate string `json:"filename_template"`
+	// SearchDefaults fill in the filters a search leaves unset
+	SearchDefaults SearchDefaults `json:"search_defaults"`
+
+	secretSources []secretSource
+	secretMutex   sync.Mutex
+}
+
+// Timeouts bound the phases of an HTTP transfer. A zero duration disables
+// the corresponding limit.
+type Timeouts struct {
+	// Connect limits establishing the TCP and TLS connection
+	Connect time.Duration `json:"connect"`
+	// ResponseHeader limits waiting for the server to start answering
+	ResponseHeader time.Duration `json:"response_header"`
+	// Idle limits how long a transfer may go without receiving any data
+	Idle time.Duration `json:"idle"`
+	// Total limits a whole download, including retries
+	Total time.Duration `json:"total"`
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect:        DefaultConnectTimeout,
+		ResponseHeader: DefaultResponseHeaderTimeout,
+		Idle:           DefaultIdleTimeout,
+		Total:          DefaultTotalTimeout,
+	}
+}
+
+// ParseTimeout reads a duration such as "90s" or "5m". Bare numbers are
+// taken as seconds.
+func ParseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = fmt.Sprintf("%ds", seconds)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("must be a non-negative duration such as 30s or 5m, got: %s", value)
+	}
+
+	return d, nil
+}
+
+// parseTimeout reads a timeout from the environment variable name.
+func parseTimeout(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := ParseTimeout(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s %w", name, err)
+	}
+	return d, nil
+}
+
+func getTimeouts(t Timeouts) (Timeouts, error) {
+	var err error
+	if t.Connect, err = parseTimeout("ANNAS_CONNECT_TIMEOUT", t.Connect); err != nil {
+		return t, err
+	}
+	if t.ResponseHeader, err = parseTimeout("ANNAS_RESPONSE_HEADER_TIMEOUT", t.ResponseHeader); err != nil {
+		return t, err
+	}
+	if t.Idle, err = parseTimeout("ANNAS_IDLE_TIMEOUT", t.Idle); err != nil {
+		return t, err
+	}
+	if t.Total, err = parseTimeout("ANNAS_TOTAL_TIMEOUT", t.Total); err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// normalizeBaseURL reduces a mirror to its host, accepting values pasted from
+// a browser such as "https://annas-archive.li/".
+func normalizeBaseURL(baseURL string) string {
+	baseURL = strings.TrimSpace(baseURL)
+	baseURL = strings.TrimPrefix(baseURL, "https://")
+	baseURL = strings.TrimPrefix(baseURL, "http://")
+	return strings.TrimRight(baseURL, "/")
+}
+
+// getBaseURLs reads the mirrors from ANNAS_BASE_URLS, a comma separated list,
+// falling back to the single ANNAS_BASE_URL, then to the configured mirrors
+// and finally to the known ones.
+func getBaseURLs(configured []string) []string {
+	candidates := configured
+	if raw := os.Getenv("ANNAS_BASE_URLS"); raw != "" {
+		candidates = strings.Split(raw, ",")
+	} else if raw := os.Getenv("ANNAS_BASE_URL"); raw != "" {
+		candidates = []string{raw}
+	}
+
+	baseURLs := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, baseURL := range candidates {
+		baseURL = normalizeBaseURL(baseURL)
+		if baseURL == "" || seen[baseURL] {
+			continue
+		}
+		seen[baseURL] = true
+		baseURLs = append(baseURLs, baseURL)
+	}
+
+	if len(baseURLs) == 0 {
+		return append([]string(nil), DefaultAnnasBaseURLs...)
+	}
+	return baseURLs
 }
 
 func GetEnv() (*Env, error) {
-	l := logger.GetLogger()
+	return getEnv("", true)
+}
 
-	secretKey := os.Getenv("ANNAS_SECRET_KEY")
-	downloadPath := os.Getenv("ANNAS_DOWNLOAD_PATH")
-	annasBaseURL := os.Getenv("ANNAS_BASE_URL")
-	if secretKey == "" || downloadPath == "" {
-		err := errors.New("ANNAS_SECRET_KEY and ANNAS_DOWNLOAD_PATH environment variables must be set")
+// GetUserEnv returns the settings of a user of a shared MCP server. They come
+// from the user's profile alone: the secret key and the download path set in
+// the environment belong to whoever runs the server, and are not shared with
+// its users.
+func GetUserEnv(name string, user *User) (*Env, error) {
+	e, err := getEnv(user.Profile, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the settings of user %q: %w", name, err)
+	}
+	e.User = name
+	return e, nil
+}
 
-		// Never log secret keys - use boolean flags instead
-		l.Error("Environment variables not set",
-			zap.Bool("ANNAS_SECRET_KEY_set", secretKey != ""),
-			zap.String("ANNAS_DOWNLOAD_PATH", downloadPath),
-			zap.String("ANNAS_BASE_URL", annasBaseURL),
-			zap.Error(err),
-		)
+// getEnv reads the settings of the named profile, or of the selected one if
+// name is empty. Environment variables take precedence over the config file,
+// except for the secret key and the download path when fromEnv is false.
+func getEnv(name string, fromEnv bool) (*Env, error) {
+	l := logger.GetLogger()
 
+	profileName, profile, err := loadProfile(name)
+	if err != nil {
 		return nil, err
 	}
 
-	if !filepath.IsAbs(downloadPath) {
+	downloadPath := profile.DownloadPath
+	if fromEnv {
+		downloadPath = getenvOr("ANNAS_DOWNLOAD_PATH", downloadPath)
+	}
+	baseURLs := getBaseURLs(profile.Mirrors)
+
+	// The secret key is only resolved when needed, so it is not logged here
+	l.Debug("Environment loaded",
+		zap.String("profile", profileName),
+		zap.String("ANNAS_DOWNLOAD_PATH", downloadPath),
+		zap.Strings("ANNAS_BASE_URLS", baseURLs),
+	)
+
+	if downloadPath != "" && !filepath.IsAbs(downloadPath) {
 		return nil, fmt.Errorf("ANNAS_DOWNLOAD_PATH must be an absolute path, got: %s", downloadPath)
 	}
 
-	if annasBaseURL == "" {
-		annasBaseURL = DefaultAnnasBaseURL
+	timeouts, err := getTimeouts(profile.Timeouts.apply(DefaultTimeouts()))
+	if err != nil {
+		return nil, err
 	}
 
 	return &Env{
-		SecretKey:    secretKey,
-		DownloadPath: downloadPath,
-		AnnasBaseURL: annasBaseURL,
+		DownloadPath:     downloadPath,
+		Profile:          profileName,
+		AnnasBaseURL:     baseURLs[0],
+		AnnasBaseURLs:    baseURLs,
+		Timeouts:         timeouts,
+		FilenameTemplate: getenvOr("ANNAS_FILENAME_TEMPLATE", profile.FilenameTemplate),
+		SearchDefaults:   profile.Search,
+		secretSources:    secretSources(profile, fromEnv),
 	}, nil
 }
+
+type contextKey struct{}
+
+// WithEnv returns a copy of ctx carrying e, which FromContext returns instead
+// of reading the settings again.
+func WithEnv(ctx context.Context, e *Env) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the settings carried by ctx, such as the ones of the
+// MCP server user who made a request, or reads them with GetEnv.
+func FromContext(ctx context.Context) (*Env, error) {
+	if e, ok := ctx.Value(contextKey{}).(*Env); ok {
+		return e, nil
+	}
+	return GetEnv()
+}
+
+// RequirePaperDownload checks the settings needed to download papers
+// through SciDB. Searching and looking up records need none.
+func (e *Env) RequirePaperDownload() error {
+	return e.require("paper download", e.DownloadPath == "", false)
+}
+
+// RequireFastDownload checks the settings needed to download files through
+// the members-only fast download API.
+func (e *Env) RequireFastDownload() error {
+	secretKey, err := e.ResolveSecretKey()
+	if err != nil {
+		return err
+	}
+	return e.require("fast download", e.DownloadPath == "", secretKey == "")
+}
+
+// require returns an error naming every setting an operation needs that is
+// not set.
+func (e *Env) require(operation string, missingPath, missingKey bool) error {
+	missing := make([]string, 0)
+	if missingKey {
+		missing = append(missing, "ANNAS_SECRET_KEY")
+	}
+	if missingPath {
+		missing = append(missing, "ANNAS_DOWNLOAD_PATH")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%s requires %s to be set, either in the environment or in the config file", operation, strings.Join(missing, " and "))
+	if missingKey {
+		err = fmt.Errorf("%w (the secret key can also be read from ANNAS_SECRET_KEY_FILE, ANNAS_SECRET_KEY_COMMAND or the keyring, see the login command)", err)
+	}
+	logger.GetLogger().Error("Missing settings",
+		zap.String("operation", operation),
+		zap.Strings("missing", missing),
+		zap.Error(err),
+	)
+	return err
+}
+
+func getenvOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
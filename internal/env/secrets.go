@@ -0,0 +1,250 @@
+package env
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"github.com/zalando/go-keyring"
+	"go.uber.org/zap"
+)
+
+const (
+	// KeyringService names the entries of this tool in the OS keyring
+	KeyringService = "annas-mcp"
+	// DefaultKeyringUser is the keyring entry used when no profile is selected
+	DefaultKeyringUser = "default"
+)
+
+// ErrSecretNotFound is returned by a SecretStore holding no key for a
+// profile.
+var ErrSecretNotFound = errors.New("secret key not found")
+
+// SecretStore keeps secret keys outside of the environment and config files,
+// one per profile.
+type SecretStore interface {
+	Get(profile string) (string, error)
+	Set(profile, secret string) error
+	Delete(profile string) error
+}
+
+// keyringStore keeps secret keys in the OS keyring, such as the Secret
+// Service on Linux, the Keychain on macOS and the Credential Manager on
+// Windows.
+type keyringStore struct{}
+
+func (keyringStore) Get(profile string) (string, error) {
+	secret, err := keyring.Get(KeyringService, keyringUser(profile))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", ErrSecretNotFound
+	}
+	return secret, err
+}
+
+func (keyringStore) Set(profile, secret string) error {
+	return keyring.Set(KeyringService, keyringUser(profile), secret)
+}
+
+func (keyringStore) Delete(profile string) error {
+	err := keyring.Delete(KeyringService, keyringUser(profile))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return ErrSecretNotFound
+	}
+	return err
+}
+
+func keyringUser(profile string) string {
+	if profile == "" {
+		return DefaultKeyringUser
+	}
+	return profile
+}
+
+var (
+	secretStoreMutex sync.Mutex
+	secretStore      SecretStore = keyringStore{}
+)
+
+// SetSecretStore replaces the store secret keys are read from and saved to,
+// for example with an in-memory one.
+func SetSecretStore(store SecretStore) {
+	secretStoreMutex.Lock()
+	defer secretStoreMutex.Unlock()
+
+	secretStore = store
+}
+
+// GetSecretStore returns the store secret keys are read from and saved to.
+func GetSecretStore() SecretStore {
+	secretStoreMutex.Lock()
+	defer secretStoreMutex.Unlock()
+
+	return secretStore
+}
+
+// MemorySecretStore keeps secret keys in memory, in place of the keyring,
+// e.g. in tests.
+type MemorySecretStore struct {
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+func NewMemorySecretStore() *MemorySecretStore {
+	return &MemorySecretStore{secrets: make(map[string]string)}
+}
+
+func (m *MemorySecretStore) Get(profile string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	secret, ok := m.secrets[keyringUser(profile)]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return secret, nil
+}
+
+func (m *MemorySecretStore) Set(profile, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.secrets[keyringUser(profile)] = secret
+	return nil
+}
+
+func (m *MemorySecretStore) Delete(profile string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.secrets[keyringUser(profile)]; !ok {
+		return ErrSecretNotFound
+	}
+	delete(m.secrets, keyringUser(profile))
+	return nil
+}
+
+// secretSource is one place the secret key may be read from. Only the first
+// source that is set is used.
+type secretSource struct {
+	name    string
+	value   string
+	resolve func(string) (string, error)
+}
+
+// secretSources lists where the secret key may come from, in order of
+// precedence: the environment, unless fromEnv is false, then the config file,
+// then the keyring.
+func secretSources(profile *Profile, fromEnv bool) []secretSource {
+	literal := func(value string) (string, error) { return value, nil }
+	sources := make([]secretSource, 0, 6)
+	if fromEnv {
+		sources = append(sources,
+			secretSource{"ANNAS_SECRET_KEY", os.Getenv("ANNAS_SECRET_KEY"), literal},
+			secretSource{"ANNAS_SECRET_KEY_FILE", os.Getenv("ANNAS_SECRET_KEY_FILE"), readSecretFile},
+			secretSource{"ANNAS_SECRET_KEY_COMMAND", os.Getenv("ANNAS_SECRET_KEY_COMMAND"), runSecretCommand},
+		)
+	}
+	return append(sources,
+		secretSource{"secret_key", profile.SecretKey, literal},
+		secretSource{"secret_key_file", profile.SecretKeyFile, readSecretFile},
+		secretSource{"secret_key_command", profile.SecretKeyCommand, runSecretCommand},
+	)
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret key file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// runSecretCommand runs a command such as "pass show anna" through the shell
+// and returns what it prints. Its stderr is passed through, so that password
+// managers can prompt for their passphrase.
+func runSecretCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("secret key command failed: %w", err)
+	}
+
+	// Password managers may print more than the secret, e.g. pass prints the
+	// password on the first line and metadata after it
+	secret, _, _ := strings.Cut(stdout.String(), "\n")
+	return strings.TrimSpace(secret), nil
+}
+
+// ResolveSecretKey returns the secret key, reading it from a file, a command
+// or the keyring on first use. Running a command or unlocking the keyring may
+// prompt the user, so it is only done by the operations that need the key.
+// Only a key that was found is kept: after a failure, or while no key is set,
+// every call looks again, so that a password manager unlocked or a key saved
+// with login later on is picked up by long-running servers.
+func (e *Env) ResolveSecretKey() (string, error) {
+	e.secretMutex.Lock()
+	defer e.secretMutex.Unlock()
+
+	if e.SecretKey == "" {
+		secret, err := e.resolveSecretKey()
+		if err != nil {
+			return "", err
+		}
+		e.SecretKey = secret
+	}
+	return e.SecretKey, nil
+}
+
+// OptionalSecretKey returns the secret key for operations that can do
+// without it, such as paper downloads, which fall back to SciDB. A key that
+// cannot be resolved is logged and treated as missing.
+func (e *Env) OptionalSecretKey() string {
+	secretKey, err := e.ResolveSecretKey()
+	if err != nil {
+		logger.GetLogger().Warn("Failed to get the secret key, skipping fast download", zap.Error(err))
+	}
+	return secretKey
+}
+
+func (e *Env) resolveSecretKey() (string, error) {
+	l := logger.GetLogger()
+
+	for _, source := range e.secretSources {
+		if source.value == "" {
+			continue
+		}
+		secret, err := source.resolve(source.value)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the secret key from %s: %w", source.name, err)
+		}
+		l.Debug("Secret key resolved", zap.String("source", source.name))
+		return secret, nil
+	}
+
+	secret, err := GetSecretStore().Get(e.Profile)
+	if errors.Is(err, ErrSecretNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		// A missing keyring, e.g. on a headless server, is the same as an
+		// empty one
+		l.Warn("Failed to read the secret key from the keyring", zap.Error(err))
+		return "", nil
+	}
+	l.Debug("Secret key resolved", zap.String("source", "keyring"))
+	return secret, nil
+}
@@ -0,0 +1,165 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSecretFile(t *testing.T, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResolveSecretKey(t *testing.T) {
+	envFile := writeSecretFile(t, "env-file")
+	configFile := writeSecretFile(t, "config-file")
+	missingFile := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name    string
+		environ map[string]string
+		profile Profile
+		fromEnv bool
+		keyring string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "environment first",
+			environ: map[string]string{"ANNAS_SECRET_KEY": "env", "ANNAS_SECRET_KEY_FILE": envFile},
+			profile: Profile{SecretKey: "config"},
+			fromEnv: true,
+			keyring: "keyring",
+			want:    "env",
+		},
+		{
+			name:    "environment file before command",
+			environ: map[string]string{"ANNAS_SECRET_KEY_FILE": envFile, "ANNAS_SECRET_KEY_COMMAND": "echo env-command"},
+			fromEnv: true,
+			want:    "env-file",
+		},
+		{
+			name:    "environment command",
+			environ: map[string]string{"ANNAS_SECRET_KEY_COMMAND": "printf 'env-command\\nmetadata\\n'"},
+			profile: Profile{SecretKey: "config"},
+			fromEnv: true,
+			want:    "env-command",
+		},
+		{
+			name:    "environment before config",
+			environ: map[string]string{"ANNAS_SECRET_KEY_COMMAND": "echo env-command"},
+			profile: Profile{SecretKey: "config"},
+			fromEnv: true,
+			want:    "env-command",
+		},
+		{
+			name:    "environment ignored for users",
+			environ: map[string]string{"ANNAS_SECRET_KEY": "env"},
+			profile: Profile{SecretKeyFile: configFile},
+			want:    "config-file",
+		},
+		{
+			name:    "config key before file",
+			profile: Profile{SecretKey: "config", SecretKeyFile: configFile},
+			fromEnv: true,
+			want:    "config",
+		},
+		{
+			name:    "config file before command",
+			profile: Profile{SecretKeyFile: configFile, SecretKeyCommand: "echo config-command"},
+			fromEnv: true,
+			want:    "config-file",
+		},
+		{
+			name:    "config command before keyring",
+			profile: Profile{SecretKeyCommand: "echo config-command"},
+			fromEnv: true,
+			keyring: "keyring",
+			want:    "config-command",
+		},
+		{
+			name:    "keyring last",
+			fromEnv: true,
+			keyring: "keyring",
+			want:    "keyring",
+		},
+		{
+			name:    "no key",
+			fromEnv: true,
+			want:    "",
+		},
+		{
+			name:    "missing file",
+			profile: Profile{SecretKeyFile: missingFile},
+			fromEnv: true,
+			keyring: "keyring",
+			wantErr: true,
+		},
+		{
+			name:    "failing command",
+			profile: Profile{SecretKeyCommand: "exit 1"},
+			fromEnv: true,
+			keyring: "keyring",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"ANNAS_SECRET_KEY", "ANNAS_SECRET_KEY_FILE", "ANNAS_SECRET_KEY_COMMAND"} {
+				t.Setenv(name, tt.environ[name])
+			}
+			store := NewMemorySecretStore()
+			if tt.keyring != "" {
+				store.Set("work", tt.keyring)
+			}
+			SetSecretStore(store)
+			t.Cleanup(func() { SetSecretStore(keyringStore{}) })
+
+			e := &Env{Profile: "work", secretSources: secretSources(&tt.profile, tt.fromEnv)}
+			got, err := e.ResolveSecretKey()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveSecretKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveSecretKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSecretKeyRetries(t *testing.T) {
+	store := NewMemorySecretStore()
+	SetSecretStore(store)
+	t.Cleanup(func() { SetSecretStore(keyringStore{}) })
+
+	path := filepath.Join(t.TempDir(), "secret")
+	e := &Env{secretSources: secretSources(&Profile{SecretKeyFile: path}, false)}
+	if _, err := e.ResolveSecretKey(); err == nil {
+		t.Fatal("ResolveSecretKey() succeeded without the secret key file")
+	}
+	if err := os.WriteFile(path, []byte("file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := e.ResolveSecretKey(); err != nil || got != "file" {
+		t.Fatalf("ResolveSecretKey() = %q, %v after the file was written, want %q", got, err, "file")
+	}
+
+	e = &Env{secretSources: secretSources(&Profile{}, false)}
+	if got, _ := e.ResolveSecretKey(); got != "" {
+		t.Fatalf("ResolveSecretKey() = %q with an empty keyring", got)
+	}
+	store.Set("", "keyring")
+	if got, _ := e.ResolveSecretKey(); got != "keyring" {
+		t.Fatalf("ResolveSecretKey() = %q after login, want %q", got, "keyring")
+	}
+	store.Delete("")
+	if got, _ := e.ResolveSecretKey(); got != "keyring" {
+		t.Fatalf("ResolveSecretKey() = %q, want the key found before to be kept", got)
+	}
+}
@@ -0,0 +1,272 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// openTimeout is how long to wait for another process, such as the MCP
+// server, to release the catalog.
+const openTimeout = 5 * time.Second
+
+var (
+	// ErrEntryNotFound is returned for a hash or DOI that is not in the
+	// catalog.
+	ErrEntryNotFound = errors.New("not in the library")
+
+	entriesBucket = []byte("entries")
+
+	// bbolt locks the file for the whole process, so opening it twice from
+	// the same process would wait for the timeout
+	dbMutex sync.Mutex
+)
+
+// Entry is a downloaded file.
+type Entry struct {
+	// MD5 is the checksum of the file, which identifies it in the catalog
+	MD5 string `json:"md5"`
+	// Hash is the MD5 of the record the file was downloaded for, which
+	// differs from MD5 when SciDB served another copy of a paper
+	Hash    string `json:"hash,omitempty"`
+	DOI     string `json:"doi,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Authors string `json:"authors,omitempty"`
+	Format  string `json:"format,omitempty"`
+	Size    int64  `json:"size"`
+	Path    string `json:"path"`
+	// Source is anna.SourceFastDownload or anna.SourceSciDB
+	Source       string    `json:"source"`
+	Mirror       string    `json:"mirror,omitempty"`
+	Verified     bool      `json:"verified"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+	// Missing tells that the file is no longer at Path, e.g. because it was
+	// moved or deleted since
+	Missing bool `json:"missing,omitempty"`
+}
+
+func (e *Entry) String() string {
+	s := fmt.Sprintf("Title: %s\nAuthors: %s\nFormat: %s\nSize: %d bytes\nMD5: %s", e.Title, e.Authors, e.Format, e.Size, e.MD5)
+	if e.Hash != "" && !strings.EqualFold(e.Hash, e.MD5) {
+		s += "\nRecord: " + e.Hash
+	}
+	if e.DOI != "" {
+		s += "\nDOI: " + e.DOI
+	}
+	s += fmt.Sprintf("\nPath: %s\nSource: %s\nDownloaded: %s", e.Path, e.Source, e.DownloadedAt.Local().Format(time.DateTime))
+	if e.Missing {
+		s += "\nThe file is no longer at its path."
+	}
+	return s
+}
+
+// EntryList wraps entries, for the structured content of tool results.
+type EntryList struct {
+	Entries []*Entry `json:"entries"`
+}
+
+// matches tells whether every word of the query appears in the entry.
+func (e *Entry) matches(words []string) bool {
+	text := strings.ToLower(strings.Join([]string{e.MD5, e.Hash, e.DOI, e.Title, e.Authors, e.Format, filepath.Base(e.Path)}, " "))
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// Catalog records the files downloaded with a profile, in a bbolt database.
+type Catalog struct {
+	path string
+}
+
+// Open returns the catalog of the profile selected in e.
+func Open(e *env.Env) (*Catalog, error) {
+	path, err := e.StatePath("library", ".db")
+	if err != nil {
+		return nil, err
+	}
+	return NewCatalog(path), nil
+}
+
+func NewCatalog(path string) *Catalog {
+	return &Catalog{path: path}
+}
+
+// NewEntry returns the entry of a downloaded file.
+func NewEntry(result *anna.DownloadResult) *Entry {
+	return &Entry{
+		MD5:      result.MD5,
+		Hash:     result.Hash,
+		DOI:      result.DOI,
+		Title:    result.Title,
+		Authors:  result.Authors,
+		Format:   strings.TrimPrefix(filepath.Ext(result.Path), "."),
+		Size:     result.Bytes,
+		Path:     result.Path,
+		Source:   result.Source,
+		Mirror:   result.Mirror,
+		Verified: result.Verified,
+	}
+}
+
+// Record adds a downloaded file to the catalog of the settings in ctx. The
+// file was downloaded anyway, so failures are logged rather than returned.
+func Record(ctx context.Context, result *anna.DownloadResult) {
+	l := logger.GetLogger()
+
+	entry := NewEntry(result)
+
+	e, err := env.FromContext(ctx)
+	if err == nil {
+		var catalog *Catalog
+		if catalog, err = Open(e); err == nil {
+			err = catalog.Add(entry)
+		}
+	}
+	if err != nil {
+		l.Warn("Failed to add the download to the library", zap.String("path", entry.Path), zap.Error(err))
+		return
+	}
+	l.Info("Download added to the library", zap.String("md5", entry.MD5), zap.String("path", entry.Path))
+}
+
+// Add records a file, replacing the entry of the same file if it was
+// downloaded before.
+func (c *Catalog) Add(entry *Entry) error {
+	if entry.MD5 == "" {
+		return errors.New("missing MD5 of the file")
+	}
+	if entry.DownloadedAt.IsZero() {
+		entry.DownloadedAt = time.Now().UTC()
+	}
+	entry.MD5 = strings.ToLower(entry.MD5)
+	entry.Hash = strings.ToLower(entry.Hash)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.update(func(bucket *bolt.Bucket) error {
+		return bucket.Put([]byte(entry.MD5), data)
+	})
+}
+
+// List returns every entry, most recently downloaded first.
+func (c *Catalog) List() ([]*Entry, error) {
+	return c.Search("")
+}
+
+// Search returns the entries containing every word of the query in their
+// title, authors, DOI, hashes, format or file name, most recently downloaded
+// first.
+func (c *Catalog) Search(query string) ([]*Entry, error) {
+	words := strings.Fields(strings.ToLower(query))
+
+	entries := make([]*Entry, 0)
+	err := c.view(func(entry *Entry) {
+		if entry.matches(words) {
+			entries = append(entries, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DownloadedAt.After(entries[j].DownloadedAt)
+	})
+	return entries, nil
+}
+
+// Get returns the entry of a file by its MD5, the MD5 of its record, or its
+// DOI.
+func (c *Catalog) Get(id string) (*Entry, error) {
+	var found *Entry
+	err := c.view(func(entry *Entry) {
+		if found != nil {
+			return
+		}
+		if strings.EqualFold(entry.MD5, id) || strings.EqualFold(entry.Hash, id) || (entry.DOI != "" && strings.EqualFold(entry.DOI, id)) {
+			found = entry
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrEntryNotFound, id)
+	}
+	return found, nil
+}
+
+// view calls fn with every entry, after checking that its file still exists.
+func (c *Catalog) view(fn func(entry *Entry)) error {
+	if _, err := os.Stat(c.path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	db, err := bolt.Open(c.path, 0o600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open library: %w", err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var entry Entry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return fmt.Errorf("failed to parse library entry %s: %w", key, err)
+			}
+			if _, err := os.Stat(entry.Path); err != nil {
+				entry.Missing = true
+			}
+			fn(&entry)
+			return nil
+		})
+	})
+}
+
+func (c *Catalog) update(fn func(bucket *bolt.Bucket) error) error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create library directory: %w", err)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	db, err := bolt.Open(c.path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open library: %w", err)
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		return fn(bucket)
+	})
+}
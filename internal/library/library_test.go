@@ -0,0 +1,234 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+	"github.com/iosifache/annas-mcp/internal/env"
+)
+
+// writeFile creates a downloaded file in dir and returns its path.
+func writeFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func entryMD5s(entries []*Entry) []string {
+	md5s := make([]string, len(entries))
+	for i, entry := range entries {
+		md5s[i] = entry.MD5
+	}
+	return md5s
+}
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	catalog := NewCatalog(filepath.Join(dir, "state", "library.db"))
+
+	// An empty catalog has no file yet
+	if entries, err := catalog.List(); err != nil || len(entries) != 0 {
+		t.Fatalf("List() of an empty catalog = %v, %v", entries, err)
+	}
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []*Entry{
+		{
+			MD5:          "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+			Hash:         "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
+			Title:        "The Go Programming Language",
+			Authors:      "Alan Donovan, Brian Kernighan",
+			Format:       "epub",
+			Path:         writeFile(t, dir, "go.epub"),
+			Source:       anna.SourceFastDownload,
+			DownloadedAt: start,
+		},
+		{
+			MD5:          "cccccccccccccccccccccccccccccccc",
+			DOI:          "10.1038/Nature12345",
+			Title:        "Deep learning",
+			Authors:      "Yann LeCun",
+			Format:       "pdf",
+			Path:         writeFile(t, dir, "deep.pdf"),
+			Source:       anna.SourceSciDB,
+			DownloadedAt: start.Add(time.Hour),
+		},
+		{
+			MD5:          "dddddddddddddddddddddddddddddddd",
+			Title:        "Programming Pearls",
+			Authors:      "Jon Bentley",
+			Format:       "pdf",
+			Path:         writeFile(t, dir, "pearls.pdf"),
+			DownloadedAt: start.Add(2 * time.Hour),
+		},
+	}
+	for _, entry := range entries {
+		if err := catalog.Add(entry); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	if err := catalog.Add(&Entry{Title: "No checksum"}); err == nil {
+		t.Error("Add() of an entry without MD5 succeeded")
+	}
+
+	t.Run("list", func(t *testing.T) {
+		got, err := catalog.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"dddddddddddddddddddddddddddddddd", "cccccccccccccccccccccccccccccccc", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+		if md5s := entryMD5s(got); !slices.Equal(md5s, want) {
+			t.Errorf("List() = %v, want the most recent first %v", md5s, want)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		tests := []struct {
+			id   string
+			want string
+		}{
+			{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+			{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+			{"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+			{"10.1038/nature12345", "cccccccccccccccccccccccccccccccc"},
+		}
+		for _, tt := range tests {
+			entry, err := catalog.Get(tt.id)
+			if err != nil || entry.MD5 != tt.want {
+				t.Errorf("Get(%s) = %v, %v, want %s", tt.id, entry, err, tt.want)
+			}
+		}
+
+		if _, err := catalog.Get("eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"); !errors.Is(err, ErrEntryNotFound) {
+			t.Errorf("Get() of an unknown hash error = %v, want %v", err, ErrEntryNotFound)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		tests := []struct {
+			query string
+			want  []string
+		}{
+			{"programming", []string{"dddddddddddddddddddddddddddddddd", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}},
+			{"PROGRAMMING kernighan", []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}},
+			{"nature12345", []string{"cccccccccccccccccccccccccccccccc"}},
+			{"pearls.pdf", []string{"dddddddddddddddddddddddddddddddd"}},
+			{"bbbbbbbb", []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}},
+			{"rust", []string{}},
+		}
+		for _, tt := range tests {
+			got, err := catalog.Search(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md5s := entryMD5s(got); !slices.Equal(md5s, tt.want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, md5s, tt.want)
+			}
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		moved := *entries[2]
+		moved.Path = writeFile(t, dir, "pearls (2).pdf")
+		if err := catalog.Add(&moved); err != nil {
+			t.Fatal(err)
+		}
+		all, err := catalog.List()
+		if err != nil || len(all) != 3 {
+			t.Fatalf("List() after downloading a file again = %d entries, %v, want 3", len(all), err)
+		}
+		if entry, _ := catalog.Get(moved.MD5); entry.Path != moved.Path {
+			t.Errorf("Get() path = %s, want the latest %s", entry.Path, moved.Path)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if err := os.Remove(entries[1].Path); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range mustList(t, catalog) {
+			if want := entry.MD5 == "cccccccccccccccccccccccccccccccc"; entry.Missing != want {
+				t.Errorf("entry %s missing = %v, want %v", entry.MD5, entry.Missing, want)
+			}
+		}
+		if entry, _ := catalog.Get("10.1038/nature12345"); entry == nil || !entry.Missing {
+			t.Errorf("Get() of a deleted file = %+v, want it marked as missing", entry)
+		}
+	})
+}
+
+func TestRecord(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	path := writeFile(t, t.TempDir(), "paper.pdf")
+
+	ctx := env.WithEnv(context.Background(), &env.Env{Profile: "lab"})
+	Record(ctx, &anna.DownloadResult{
+		Path:     path,
+		Bytes:    9,
+		MD5:      "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+		Verified: true,
+		Hash:     "0123456789abcdef0123456789abcdef",
+		DOI:      "10.1000/x",
+		Title:    "A paper",
+		Authors:  "Someone",
+		Source:   anna.SourceSciDB,
+		Mirror:   "annas-archive.li",
+	})
+
+	// The entry goes to the catalog of the profile in ctx
+	catalog, err := Open(&env.Env{Profile: "lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := catalog.Get("10.1000/x")
+	if err != nil {
+		t.Fatalf("Get() of the recorded paper error = %v", err)
+	}
+	want := Entry{
+		MD5:          "ffffffffffffffffffffffffffffffff",
+		Hash:         "0123456789abcdef0123456789abcdef",
+		DOI:          "10.1000/x",
+		Title:        "A paper",
+		Authors:      "Someone",
+		Format:       "pdf",
+		Size:         9,
+		Path:         path,
+		Source:       anna.SourceSciDB,
+		Mirror:       "annas-archive.li",
+		Verified:     true,
+		DownloadedAt: entry.DownloadedAt,
+	}
+	if *entry != want {
+		t.Errorf("recorded entry = %+v, want %+v", *entry, want)
+	}
+	if entry.DownloadedAt.IsZero() {
+		t.Error("recorded entry has no download time")
+	}
+
+	other, err := Open(&env.Env{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := mustList(t, other); len(entries) != 0 {
+		t.Errorf("catalog of another profile has %d entries", len(entries))
+	}
+}
+
+func mustList(t *testing.T, catalog *Catalog) []*Entry {
+	t.Helper()
+	entries, err := catalog.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
@@ -1,15 +1,22 @@
 package modes
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/charmbracelet/fang"
+	"github.com/charmbracelet/x/term"
 	"github.com/iosifache/annas-mcp/internal/anna"
 	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/library"
 	"github.com/iosifache/annas-mcp/internal/logger"
 	"github.com/iosifache/annas-mcp/internal/version"
 	"github.com/joho/godotenv"
@@ -33,11 +40,17 @@ func StartCLI() {
 			DisableDefaultCmd: true,
 		},
 		Version: version.GetVersion(),
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if profile, _ := cmd.Flags().GetString("profile"); profile != "" {
+				env.SetProfile(profile)
+			}
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return cmd.Help()
 		},
 	}
 	rootCmd.SetVersionTemplate("{{.Version}}\n")
+	rootCmd.PersistentFlags().String("profile", "", "Config file profile to use (defaults to ANNAS_PROFILE, then to default_profile in the config file)")
 
 	searchCmd := &cobra.Command{
 		Use:   "search [term]",
@@ -45,9 +58,39 @@ func StartCLI() {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			searchTerm := args[0]
-			l.Info("Search command called", zap.String("searchTerm", searchTerm))
+			page, _ := cmd.Flags().GetInt("page")
+			languages, _ := cmd.Flags().GetStringSlice("lang")
+			extensions, _ := cmd.Flags().GetStringSlice("ext")
+			sources, _ := cmd.Flags().GetStringSlice("source")
+			yearFrom, _ := cmd.Flags().GetInt("year-from")
+			yearTo, _ := cmd.Flags().GetInt("year-to")
+			sort, _ := cmd.Flags().GetString("sort")
+			output, _ := cmd.Flags().GetString("output")
+			if err := validateOutputFormat(output); err != nil {
+				return err
+			}
+			l.Info("Search command called",
+				zap.String("searchTerm", searchTerm),
+				zap.Int("page", page),
+				zap.Strings("languages", languages),
+				zap.Strings("extensions", extensions),
+				zap.Strings("sources", sources),
+				zap.Int("yearFrom", yearFrom),
+				zap.Int("yearTo", yearTo),
+				zap.String("sort", sort),
+				zap.String("output", output),
+			)
 
-			books, err := anna.FindBook(searchTerm, "book_any")
+			result, err := anna.FindBook(cmd.Context(), anna.SearchOptions{
+				Query:      searchTerm,
+				Page:       page,
+				Languages:  languages,
+				Extensions: extensions,
+				Sources:    sources,
+				YearFrom:   yearFrom,
+				YearTo:     yearTo,
+				Sort:       sort,
+			})
 			if err != nil {
 				l.Error("Search command failed",
 					zap.String("searchTerm", searchTerm),
@@ -56,31 +99,34 @@ func StartCLI() {
 				return fmt.Errorf("failed to search books: %w", err)
 			}
 
-			if len(books) == 0 {
-				fmt.Println("No books found.")
-				return nil
-			}
-
-			for i, book := range books {
-				fmt.Printf("Book %d:\n%s\n", i+1, book.String())
-				if i < len(books)-1 {
-					fmt.Println()
-				}
+			if err := writeSearchResult(os.Stdout, output, result); err != nil {
+				return fmt.Errorf("failed to write search results: %w", err)
 			}
 
 			l.Info("Search command completed successfully",
 				zap.String("searchTerm", searchTerm),
-				zap.Int("resultsCount", len(books)),
+				zap.Int("page", result.Page),
+				zap.Int("resultsCount", len(result.Books)),
+				zap.Bool("hasMore", result.HasMore),
 			)
 
 			return nil
 		},
 	}
 
+	searchCmd.Flags().Int("page", 1, "Results page to fetch, starting at 1")
+	searchCmd.Flags().StringSlice("lang", nil, "Only show books in these languages (e.g. en,de)")
+	searchCmd.Flags().StringSlice("ext", nil, "Only show these file types (e.g. epub,pdf)")
+	searchCmd.Flags().StringSlice("source", nil, "Only show books from these source libraries (e.g. lgli,zlib)")
+	searchCmd.Flags().Int("year-from", 0, "Only show books published in or after this year, filtering each page, which may leave it short or empty")
+	searchCmd.Flags().Int("year-to", 0, "Only show books published in or before this year, filtering each page, which may leave it short or empty")
+	searchCmd.Flags().String("sort", "", "Sort order: relevant, newest, oldest, largest, smallest, newest_added or oldest_added")
+	searchCmd.Flags().StringP("output", "o", outputText, "Output format: "+strings.Join(outputFormats, ", "))
+
 	downloadCmd := &cobra.Command{
 		Use:   "download [hash] [filename]",
 		Short: "Download a book by its MD5 hash",
-		Long:  "Download a book by its MD5 hash to the specified filename. Requires ANNAS_SECRET_KEY and ANNAS_DOWNLOAD_PATH environment variables.",
+		Long:  "Download a book by its MD5 hash to the specified filename. Requires ANNAS_SECRET_KEY and ANNAS_DOWNLOAD_PATH, set in the environment or in the config file.",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			bookHash := args[0]
@@ -105,6 +151,9 @@ func StartCLI() {
 				l.Error("Failed to get environment variables", zap.Error(err))
 				return fmt.Errorf("failed to get environment: %w", err)
 			}
+			if err := env.RequireFastDownload(); err != nil {
+				return err
+			}
 
 			book := &anna.Book{
 				Hash:   bookHash,
@@ -112,7 +161,14 @@ func StartCLI() {
 				Format: format,
 			}
 
-			err = book.Download(env.SecretKey, env.DownloadPath)
+			timeouts := timeoutFlags(cmd, env.Timeouts)
+
+			bar := newProgressBar()
+			result, err := book.Download(cmd.Context(), env.SecretKey, env.DownloadPath, &anna.DownloadOptions{
+				Progress: bar.Progress(),
+				Timeouts: &timeouts,
+			})
+			bar.Finish()
 			if err != nil {
 				l.Error("Download command failed",
 					zap.String("bookHash", bookHash),
@@ -121,41 +177,227 @@ func StartCLI() {
 				)
 				return fmt.Errorf("failed to download book: %w", err)
 			}
+			library.Record(cmd.Context(), result)
 
-			fullPath := filepath.Join(env.DownloadPath, filename)
-			fmt.Printf("Book downloaded successfully to: %s\n", fullPath)
+			fmt.Printf("Book downloaded successfully to: %s\n", result.Path)
+			fmt.Printf("MD5 verified: %s\n", result.MD5)
 
 			l.Info("Download command completed successfully",
 				zap.String("bookHash", bookHash),
-				zap.String("downloadPath", env.DownloadPath),
-				zap.String("filename", filename),
+				zap.String("path", result.Path),
+				zap.Int64("bytes", result.Bytes),
+				zap.String("md5", result.MD5),
+			)
+
+			return nil
+		},
+	}
+
+	addTimeoutFlags(downloadCmd)
+
+	detailsCmd := &cobra.Command{
+		Use:   "details [hash]",
+		Short: "Show the full record of a book by its MD5 hash",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bookHash := args[0]
+			l.Info("Details command called", zap.String("bookHash", bookHash))
+
+			details, err := anna.GetBookDetails(cmd.Context(), bookHash)
+			if err != nil {
+				l.Error("Details command failed",
+					zap.String("bookHash", bookHash),
+					zap.Error(err),
+				)
+				return fmt.Errorf("failed to get book details: %w", err)
+			}
+
+			fmt.Println(details.String())
+
+			l.Info("Details command completed successfully", zap.String("bookHash", bookHash))
+
+			return nil
+		},
+	}
+
+	loginCmd := &cobra.Command{
+		Use:   "login",
+		Short: "Store the Anna's Archive secret key in the OS keyring",
+		Long:  "Store the Anna's Archive secret key in the OS keyring, so that it does not have to be kept in environment variables or config files. The key is stored for the selected profile and read from standard input when it is not a terminal.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secrets := env.GetSecretStore()
+			env, err := env.GetEnv()
+			if err != nil {
+				return fmt.Errorf("failed to get environment: %w", err)
+			}
+			l.Info("Login command called", zap.String("profile", env.Profile))
+
+			secretKey, err := readSecretKey()
+			if err != nil {
+				return fmt.Errorf("failed to read secret key: %w", err)
+			}
+			if secretKey == "" {
+				return fmt.Errorf("no secret key given")
+			}
+
+			if err := secrets.Set(env.Profile, secretKey); err != nil {
+				l.Error("Login command failed", zap.Error(err))
+				return fmt.Errorf("failed to store secret key: %w", err)
+			}
+
+			if env.Profile == "" {
+				fmt.Println("Secret key stored in the keyring.")
+			} else {
+				fmt.Printf("Secret key stored in the keyring for profile %s.\n", env.Profile)
+			}
+
+			l.Info("Login command completed successfully", zap.String("profile", env.Profile))
+
+			return nil
+		},
+	}
+
+	accountCmd := &cobra.Command{
+		Use:   "account",
+		Short: "Show the remaining fast downloads of the account",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l.Info("Account command called")
+
+			status, err := anna.GetAccountStatus(cmd.Context())
+			if err != nil {
+				l.Error("Account command failed", zap.Error(err))
+				return fmt.Errorf("failed to get account status: %w", err)
+			}
+
+			fmt.Println(status.String())
+
+			l.Info("Account command completed successfully",
+				zap.Bool("known", status.Known),
+				zap.Int("downloadsLeft", status.DownloadsLeft),
 			)
 
 			return nil
 		},
 	}
 
+	mirrorsCmd := &cobra.Command{
+		Use:   "mirrors",
+		Short: "Check which Anna's Archive mirrors are working",
+		Long:  "Probe every configured mirror for search page reachability, latency, fast download API availability and page layout.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l.Info("Mirrors command called")
+
+			report, err := anna.CheckMirrors(cmd.Context())
+			if err != nil {
+				l.Error("Mirrors command failed", zap.Error(err))
+				return fmt.Errorf("failed to check mirrors: %w", err)
+			}
+
+			if err := writeMirrorReport(os.Stdout, report); err != nil {
+				return fmt.Errorf("failed to write mirror status: %w", err)
+			}
+
+			l.Info("Mirrors command completed successfully", zap.Int("mirrors", len(report.Mirrors)))
+
+			return nil
+		},
+	}
+
 	mcpCmd := &cobra.Command{
 		Use:   "mcp",
 		Short: "Start the MCP server",
-		Long:  "Start the Model Context Protocol (MCP) server for integration with AI assistants.",
+		Long:  "Start the Model Context Protocol (MCP) server for integration with AI assistants. By default, the server talks to the client that started it over stdio. With `--transport http` or `--transport sse`, it listens for remote clients instead, so that a single instance can serve several of them. The users defined in the config file then have to authenticate with their bearer token, and download with the settings of their own profile.",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			transport, _ := cmd.Flags().GetString("transport")
+			listen, _ := cmd.Flags().GetString("listen")
+			auditLog, _ := cmd.Flags().GetString("audit-log")
+			allowUnauthenticated, _ := cmd.Flags().GetBool("allow-unauthenticated")
+			if err := ValidateTransport(transport); err != nil {
+				return err
+			}
+
 			// Exit CLI mode and start MCP server
-			StartMCPServer()
+			StartMCPServer(cmd.Context(), &ServerOptions{
+				Transport:            transport,
+				Listen:               listen,
+				AuditLog:             auditLog,
+				AllowUnauthenticated: allowUnauthenticated,
+			})
 			return nil
 		},
 	}
+	mcpCmd.Flags().String("transport", TransportStdio, "Transport to serve: stdio, http (streamable HTTP on /mcp and SSE on /sse) or sse (SSE on /sse only)")
+	mcpCmd.Flags().String("listen", DefaultListenAddress, "Address to listen on with the http and sse transports")
+	mcpCmd.Flags().String("audit-log", "", "File to append every tool call to, with the user who made it, as JSON lines")
+	mcpCmd.Flags().Bool("allow-unauthenticated", false, "Serve clients on other interfaces than loopback without users in the config file, sharing the settings and files of the server with anyone who can reach it")
 
 	rootCmd.AddCommand(searchCmd)
 	rootCmd.AddCommand(downloadCmd)
+	rootCmd.AddCommand(detailsCmd)
+	rootCmd.AddCommand(mirrorsCmd)
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(accountCmd)
+	rootCmd.AddCommand(newPapersCmd())
+	rootCmd.AddCommand(newQueueCmd())
+	rootCmd.AddCommand(newLibraryCmd())
 	rootCmd.AddCommand(mcpCmd)
 
+	// Interrupting a command cancels whatever request or download it runs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	if err := fang.Execute(
-		context.Background(),
+		ctx,
 		rootCmd,
 		fang.WithVersion(version.GetVersion()),
 	); err != nil {
+		stop()
 		os.Exit(1)
 	}
 }
+
+// addTimeoutFlags adds the flags read by timeoutFlags to a download command.
+func addTimeoutFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("connect-timeout", 0, "Maximum time to establish a connection (defaults to ANNAS_CONNECT_TIMEOUT)")
+	cmd.Flags().Duration("header-timeout", 0, "Maximum time to wait for the response headers (defaults to ANNAS_RESPONSE_HEADER_TIMEOUT)")
+	cmd.Flags().Duration("idle-timeout", 0, "Abort when no data is received for this long (defaults to ANNAS_IDLE_TIMEOUT)")
+	cmd.Flags().Duration("total-timeout", 0, "Maximum duration of the whole download, 0 for no limit (defaults to ANNAS_TOTAL_TIMEOUT)")
+}
+
+// timeoutFlags overrides the configured timeouts with the ones set on the
+// command line.
+func timeoutFlags(cmd *cobra.Command, timeouts env.Timeouts) env.Timeouts {
+	flags := map[string]*time.Duration{
+		"connect-timeout": &timeouts.Connect,
+		"header-timeout":  &timeouts.ResponseHeader,
+		"idle-timeout":    &timeouts.Idle,
+		"total-timeout":   &timeouts.Total,
+	}
+	for name, target := range flags {
+		if cmd.Flags().Changed(name) {
+			*target, _ = cmd.Flags().GetDuration(name)
+		}
+	}
+	return timeouts
+}
+
+// readSecretKey prompts for the secret key without echoing it, or reads the
+// first line of standard input when it is not a terminal.
+func readSecretKey() (string, error) {
+	if term.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprint(os.Stderr, "Anna's Archive secret key: ")
+		secretKey, err := term.ReadPassword(os.Stdin.Fd())
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(secretKey)), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
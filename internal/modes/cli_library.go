@@ -0,0 +1,154 @@
+package modes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/library"
+	"github.com/spf13/cobra"
+)
+
+// openLibrary returns the library of the selected profile, or of the MCP
+// server user ctx belongs to.
+func openLibrary(ctx context.Context) (*library.Catalog, error) {
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment: %w", err)
+	}
+	catalog, err := library.Open(env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open library: %w", err)
+	}
+	return catalog, nil
+}
+
+// validateLibraryFormat checks the output format of the library commands.
+func validateLibraryFormat(format string, formats ...string) error {
+	for _, f := range formats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported output format %q, expected one of: %s", format, strings.Join(formats, ", "))
+}
+
+func newLibraryCmd() *cobra.Command {
+	libraryCmd := &cobra.Command{
+		Use:   "library",
+		Short: "Browse the files downloaded so far",
+		Long:  "Browse the library, which records every file downloaded with the selected profile: its hash, DOI, title, authors, format, size, path, and when and how it was downloaded.",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the downloaded files, most recent first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+			if err := validateLibraryFormat(output, outputTable, outputJSON); err != nil {
+				return err
+			}
+
+			catalog, err := openLibrary(cmd.Context())
+			if err != nil {
+				return err
+			}
+			entries, err := catalog.List()
+			if err != nil {
+				return fmt.Errorf("failed to list library: %w", err)
+			}
+
+			return writeLibrary(os.Stdout, output, entries)
+		},
+	}
+	listCmd.Flags().StringP("output", "o", outputTable, "Output format: table or json")
+
+	searchCmd := &cobra.Command{
+		Use:   "search [query]",
+		Short: "Find downloaded files by title, authors, DOI or hash",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+			if err := validateLibraryFormat(output, outputTable, outputJSON); err != nil {
+				return err
+			}
+
+			catalog, err := openLibrary(cmd.Context())
+			if err != nil {
+				return err
+			}
+			entries, err := catalog.Search(strings.Join(args, " "))
+			if err != nil {
+				return fmt.Errorf("failed to search library: %w", err)
+			}
+
+			return writeLibrary(os.Stdout, output, entries)
+		},
+	}
+	searchCmd.Flags().StringP("output", "o", outputTable, "Output format: table or json")
+
+	showCmd := &cobra.Command{
+		Use:   "show [md5|doi]",
+		Short: "Show a downloaded file by its MD5 hash or DOI",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+			if err := validateLibraryFormat(output, outputText, outputJSON); err != nil {
+				return err
+			}
+
+			catalog, err := openLibrary(cmd.Context())
+			if err != nil {
+				return err
+			}
+			entry, err := catalog.Get(args[0])
+			if err != nil {
+				return err
+			}
+
+			if output == outputJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(entry)
+			}
+			fmt.Println(entry.String())
+			return nil
+		},
+	}
+	showCmd.Flags().StringP("output", "o", outputText, "Output format: text or json")
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write the whole library as JSON or CSV",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+			if err := validateLibraryFormat(output, outputJSON, outputCSV); err != nil {
+				return err
+			}
+
+			catalog, err := openLibrary(cmd.Context())
+			if err != nil {
+				return err
+			}
+			entries, err := catalog.List()
+			if err != nil {
+				return fmt.Errorf("failed to list library: %w", err)
+			}
+
+			return writeLibrary(os.Stdout, output, entries)
+		},
+	}
+	exportCmd.Flags().StringP("output", "o", outputJSON, "Output format: json or csv")
+
+	libraryCmd.AddCommand(listCmd)
+	libraryCmd.AddCommand(searchCmd)
+	libraryCmd.AddCommand(showCmd)
+	libraryCmd.AddCommand(exportCmd)
+
+	return libraryCmd
+}
@@ -0,0 +1,253 @@
+package modes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"github.com/iosifache/annas-mcp/internal/queue"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// openQueue returns the settings and the download queue of the selected
+// profile, or of the MCP server user ctx belongs to.
+func openQueue(ctx context.Context) (*env.Env, *queue.Store, error) {
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get environment: %w", err)
+	}
+	store, err := queue.Open(env)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open download queue: %w", err)
+	}
+	return env, store, nil
+}
+
+func newQueueCmd() *cobra.Command {
+	l := logger.GetLogger()
+
+	queueCmd := &cobra.Command{
+		Use:   "queue",
+		Short: "Queue downloads and run them in the background",
+		Long:  "Manage the persistent download queue. Jobs added to the queue are downloaded by `queue run` or by a running MCP server, several at a time, and retried with backoff when they fail.",
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add [hash] [filename]",
+		Short: "Queue a book by its MD5 hash, or papers by their DOIs",
+		Args: func(cmd *cobra.Command, args []string) error {
+			dois, _ := cmd.Flags().GetStringSlice("doi")
+			if len(args) == 0 && len(dois) > 0 {
+				return nil
+			}
+			return cobra.ExactArgs(2)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dois, _ := cmd.Flags().GetStringSlice("doi")
+
+			var jobs []*queue.Job
+			if len(args) == 2 {
+				ext := filepath.Ext(args[1])
+				if ext == "" {
+					return fmt.Errorf("filename must include an extension (e.g., .pdf, .epub)")
+				}
+				jobs = append(jobs, &queue.Job{
+					Kind:   queue.KindBook,
+					Hash:   args[0],
+					Title:  strings.TrimSuffix(filepath.Base(args[1]), ext),
+					Format: strings.TrimPrefix(ext, "."),
+				})
+			}
+			for _, doi := range dois {
+				jobs = append(jobs, &queue.Job{Kind: queue.KindPaper, DOI: doi})
+			}
+
+			_, store, err := openQueue(cmd.Context())
+			if err != nil {
+				return err
+			}
+			added, err := store.Add(jobs...)
+			if err != nil {
+				l.Error("Queue add command failed", zap.Error(err))
+				return fmt.Errorf("failed to queue downloads: %w", err)
+			}
+
+			for _, job := range added {
+				fmt.Printf("%s\t%s\t%s\n", job.ID, job.State, job.Target())
+			}
+
+			l.Info("Queue add command completed successfully", zap.Int("jobs", len(added)))
+
+			return nil
+		},
+	}
+	addCmd.Flags().StringSlice("doi", nil, "DOIs of papers to queue, instead of or along with a book")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Show the jobs in the queue",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state, _ := cmd.Flags().GetString("state")
+
+			_, store, err := openQueue(cmd.Context())
+			if err != nil {
+				return err
+			}
+			jobs, err := store.List()
+			if err != nil {
+				return fmt.Errorf("failed to list downloads: %w", err)
+			}
+
+			return writeJobs(os.Stdout, filterJobs(jobs, state))
+		},
+	}
+	listCmd.Flags().String("state", "", "Only show jobs in this state: queued, running, done, failed or cancelled")
+
+	cancelCmd := &cobra.Command{
+		Use:   "cancel [id...]",
+		Short: "Cancel queued or running jobs",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, store, err := openQueue(cmd.Context())
+			if err != nil {
+				return err
+			}
+			for _, id := range args {
+				job, err := store.Cancel(id)
+				if err != nil {
+					return fmt.Errorf("failed to cancel job: %w", err)
+				}
+				fmt.Printf("%s\t%s\t%s\n", job.ID, job.State, job.Target())
+			}
+			return nil
+		},
+	}
+
+	retryCmd := &cobra.Command{
+		Use:   "retry [id...]",
+		Short: "Queue failed or cancelled jobs again",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if all, _ := cmd.Flags().GetBool("all"); all {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, store, err := openQueue(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			if all, _ := cmd.Flags().GetBool("all"); all {
+				jobs, err := store.List()
+				if err != nil {
+					return fmt.Errorf("failed to list downloads: %w", err)
+				}
+				for _, job := range filterJobs(jobs, string(queue.StateFailed)) {
+					args = append(args, job.ID)
+				}
+			}
+
+			for _, id := range args {
+				job, err := store.Retry(id)
+				if err != nil {
+					return fmt.Errorf("failed to retry job: %w", err)
+				}
+				fmt.Printf("%s\t%s\t%s\n", job.ID, job.State, job.Target())
+			}
+			return nil
+		},
+	}
+	retryCmd.Flags().Bool("all", false, "Retry every failed job")
+
+	clearCmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove the jobs that are done or cancelled",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, store, err := openQueue(cmd.Context())
+			if err != nil {
+				return err
+			}
+			removed, err := store.Clear()
+			if err != nil {
+				return fmt.Errorf("failed to clear queue: %w", err)
+			}
+			fmt.Printf("Removed %d jobs.\n", removed)
+			return nil
+		},
+	}
+
+	runCmd := &cobra.Command{
+		Use:   "run",
+		Short: "Download the queued jobs",
+		Long:  "Download the queued jobs, several at a time, and exit once the queue is empty. Interrupting the command suspends the running jobs, which resume from their partial files on the next run.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			workers, _ := cmd.Flags().GetInt("workers")
+			perHost, _ := cmd.Flags().GetInt("per-host")
+			attempts, _ := cmd.Flags().GetInt("attempts")
+
+			env, store, err := openQueue(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			var failed atomic.Int64
+			runner := queue.NewRunner(store, env, &queue.Options{
+				Workers:      workers,
+				PerHost:      perHost,
+				MaxAttempts:  attempts,
+				ExitWhenIdle: true,
+				OnUpdate: func(job *queue.Job) {
+					if job.State == queue.StateFailed {
+						failed.Add(1)
+					}
+					fmt.Printf("%s\t%s\t%s\t%s\n", job.ID, job.State, job.Target(), jobDetails(job))
+				},
+			})
+
+			if err := runner.Run(cmd.Context()); err != nil {
+				return fmt.Errorf("download queue stopped: %w", err)
+			}
+			if n := failed.Load(); n > 0 {
+				return fmt.Errorf("%d jobs failed, see `annas-mcp queue list --state failed`", n)
+			}
+			return nil
+		},
+	}
+	runCmd.Flags().Int("workers", queue.DefaultWorkers, "Number of jobs to download at the same time")
+	runCmd.Flags().Int("per-host", queue.DefaultPerHost, "Number of files to download at the same time from a single host")
+	runCmd.Flags().Int("attempts", queue.DefaultMaxAttempts, "Number of attempts before a job is failed")
+
+	queueCmd.AddCommand(addCmd)
+	queueCmd.AddCommand(listCmd)
+	queueCmd.AddCommand(cancelCmd)
+	queueCmd.AddCommand(retryCmd)
+	queueCmd.AddCommand(clearCmd)
+	queueCmd.AddCommand(runCmd)
+
+	return queueCmd
+}
+
+// filterJobs returns the jobs in the given state, or all of them if state is
+// empty.
+func filterJobs(jobs []*queue.Job, state string) []*queue.Job {
+	if state == "" {
+		return jobs
+	}
+	filtered := make([]*queue.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if string(job.State) == state {
+			filtered = append(filtered, job)
+		}
+	}
+	return filtered
+}
@@ -2,24 +2,154 @@ package modes
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/iosifache/annas-mcp/internal/anna"
 	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/library"
 	"github.com/iosifache/annas-mcp/internal/logger"
+	"github.com/iosifache/annas-mcp/internal/queue"
 	"github.com/iosifache/annas-mcp/internal/version"
+	"github.com/modelcontextprotocol/go-sdk/jsonschema"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 	"go.uber.org/zap"
 )
 
-func SearchTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[SearchParams]) (*mcp.CallToolResultFor[any], error) {
+// newStructuredTool is like mcp.NewServerTool, but declares the output schema
+// inferred from Out and forwards the handler's structured content to the
+// client. The SDK does not do either for typed tools yet.
+func newStructuredTool[In, Out any](name, description string, handler mcp.ToolHandlerFor[In, Out], opts ...mcp.ToolOption) *mcp.ServerTool {
+	typed := mcp.NewServerTool(name, description, handler, opts...)
+
+	outputSchema, err := jsonschema.For[Out]()
+	if err != nil {
+		panic(fmt.Errorf("newStructuredTool(%q): %w", name, err))
+	}
+	typed.Tool.OutputSchema = outputSchema
+
+	return &mcp.ServerTool{
+		Tool: typed.Tool,
+		Handler: func(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[map[string]any]) (*mcp.CallToolResult, error) {
+			// The arguments were already validated against the input schema
+			raw, err := json.Marshal(params.Arguments)
+			if err != nil {
+				return nil, err
+			}
+			var args In
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return nil, err
+			}
+
+			res, err := handler(ctx, cc, &mcp.CallToolParamsFor[In]{
+				Meta:      params.Meta,
+				Name:      params.Name,
+				Arguments: args,
+			})
+			if err != nil || res == nil {
+				return nil, err
+			}
+
+			result := &mcp.CallToolResult{
+				Meta:    res.Meta,
+				Content: res.Content,
+				IsError: res.IsError,
+			}
+			if !res.IsError {
+				result.StructuredContent = res.StructuredContent
+			}
+			return result, nil
+		},
+	}
+}
+
+// apply overrides the timeouts with the ones given to a tool, which are
+// durations such as "90s" or a number of seconds.
+func (p *TimeoutParams) apply(timeouts env.Timeouts) (env.Timeouts, error) {
+	if p == nil {
+		return timeouts, nil
+	}
+	overrides := []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"connect", p.Connect, &timeouts.Connect},
+		{"response_header", p.ResponseHeader, &timeouts.ResponseHeader},
+		{"idle", p.Idle, &timeouts.Idle},
+		{"total", p.Total, &timeouts.Total},
+	}
+	for _, override := range overrides {
+		if override.value == "" {
+			continue
+		}
+		d, err := env.ParseTimeout(override.value)
+		if err != nil {
+			return timeouts, fmt.Errorf("timeout %s %w", override.name, err)
+		}
+		*override.target = d
+	}
+	return timeouts, nil
+}
+
+// progressNotifier returns a callback forwarding download progress to the
+// client as MCP progress notifications, or nil if the client did not ask for
+// progress by sending a progress token.
+func progressNotifier(ctx context.Context, cc *mcp.ServerSession, token any) anna.ProgressFunc {
+	if token == nil {
+		return nil
+	}
+	l := logger.GetLogger()
+
+	return func(done, total int64) {
+		notification := &mcp.ProgressNotificationParams{
+			ProgressToken: token,
+			Progress:      float64(done),
+		}
+		if total > 0 {
+			notification.Total = float64(total)
+			notification.Message = fmt.Sprintf("Downloaded %s of %s", formatBytes(done), formatBytes(total))
+		} else {
+			notification.Message = fmt.Sprintf("Downloaded %s", formatBytes(done))
+		}
+		if err := cc.NotifyProgress(ctx, notification); err != nil {
+			l.Warn("Failed to send progress notification", zap.Error(err))
+		}
+	}
+}
+
+func SearchTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[SearchParams]) (*mcp.CallToolResultFor[anna.SearchResult], error) {
 	l := logger.GetLogger()
 
 	l.Info("Search command called",
 		zap.String("searchTerm", params.Arguments.SearchTerm),
 		zap.String("content", params.Arguments.Content),
+		zap.Int("page", params.Arguments.Page),
+		zap.Strings("language", params.Arguments.Language),
+		zap.Strings("extension", params.Arguments.Extension),
+		zap.Strings("source", params.Arguments.Source),
+		zap.Int("yearFrom", params.Arguments.YearFrom),
+		zap.Int("yearTo", params.Arguments.YearTo),
+		zap.String("sort", params.Arguments.Sort),
 	)
 
-	books, err := anna.FindBook(params.Arguments.SearchTerm, params.Arguments.Content)
+	result, err := anna.FindBook(ctx, anna.SearchOptions{
+		Query:      params.Arguments.SearchTerm,
+		Content:    params.Arguments.Content,
+		Page:       params.Arguments.Page,
+		Languages:  params.Arguments.Language,
+		Extensions: params.Arguments.Extension,
+		Sources:    params.Arguments.Source,
+		YearFrom:   params.Arguments.YearFrom,
+		YearTo:     params.Arguments.YearTo,
+		Sort:       params.Arguments.Sort,
+	})
 	if err != nil {
 		l.Error("Search command failed",
 			zap.String("searchTerm", params.Arguments.SearchTerm),
@@ -28,12 +158,21 @@ func SearchTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTool
 		return nil, err
 	}
 
+	books := result.Books
 	if len(books) == 0 {
 		l.Info("Search returned no results",
 			zap.String("searchTerm", params.Arguments.SearchTerm),
+			zap.Int("page", result.Page),
 		)
-		return &mcp.CallToolResultFor[any]{
-			Content: []mcp.Content{&mcp.TextContent{Text: "No books found."}},
+		// Year filters are applied to each page, so an empty page may still
+		// be followed by others
+		text := "No books found."
+		if result.HasMore {
+			text = fmt.Sprintf("No matches on this page, but more results are available. Call search again with page=%d to see them.", result.Page+1)
+		}
+		return &mcp.CallToolResultFor[anna.SearchResult]{
+			Content:           []mcp.Content{&mcp.TextContent{Text: text}},
+			StructuredContent: *result,
 		}, nil
 	}
 
@@ -41,31 +180,88 @@ func SearchTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTool
 	for _, book := range books {
 		bookList += book.String() + "\n\n"
 	}
+	if result.HasMore {
+		bookList += fmt.Sprintf("More results are available. Call search again with page=%d to see them.", result.Page+1)
+	} else {
+		bookList += "No more results."
+	}
 
 	l.Info("Search command completed successfully",
 		zap.String("searchTerm", params.Arguments.SearchTerm),
+		zap.Int("page", result.Page),
 		zap.Int("resultsCount", len(books)),
+		zap.Bool("hasMore", result.HasMore),
 	)
 
-	return &mcp.CallToolResultFor[any]{
-		Content: []mcp.Content{&mcp.TextContent{Text: bookList}},
+	return &mcp.CallToolResultFor[anna.SearchResult]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: bookList}},
+		StructuredContent: *result,
 	}, nil
 }
 
-func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DownloadParams]) (*mcp.CallToolResultFor[any], error) {
+// DownloadOutput is the result of the download tools: the downloaded file,
+// or the job downloading it in the background when called with async.
+type DownloadOutput struct {
+	Result *anna.DownloadResult `json:"result,omitempty"`
+	Job    *queue.Job           `json:"job,omitempty"`
+}
+
+// queueDownload adds a job to the queue for the async mode of the download
+// tools.
+func queueDownload(ctx context.Context, job *queue.Job) (*mcp.CallToolResultFor[DownloadOutput], error) {
+	_, store, err := openQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	added, err := store.Add(job)
+	if err != nil {
+		return nil, err
+	}
+	job = added[0]
+
+	logger.GetLogger().Info("Download queued",
+		zap.String("id", job.ID),
+		zap.String("target", job.Target()),
+	)
+
+	return &mcp.CallToolResultFor[DownloadOutput]{
+		Content: []mcp.Content{&mcp.TextContent{
+			Text: fmt.Sprintf("Download queued as job %s. Call download_status with this ID to follow it.\n%s", job.ID, job.String()),
+		}},
+		StructuredContent: DownloadOutput{Job: job},
+	}, nil
+}
+
+func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DownloadParams]) (*mcp.CallToolResultFor[DownloadOutput], error) {
 	l := logger.GetLogger()
 
 	l.Info("Download command called",
 		zap.String("bookHash", params.Arguments.BookHash),
 		zap.String("title", params.Arguments.Title),
 		zap.String("format", params.Arguments.Format),
+		zap.Bool("async", params.Arguments.Async),
 	)
 
-	env, err := env.GetEnv()
+	env, err := env.FromContext(ctx)
 	if err != nil {
 		l.Error("Failed to get environment variables", zap.Error(err))
 		return nil, err
 	}
+	if err := env.RequireFastDownload(); err != nil {
+		return nil, err
+	}
+	if params.Arguments.Async {
+		return queueDownload(ctx, &queue.Job{
+			Kind:   queue.KindBook,
+			Hash:   params.Arguments.BookHash,
+			Title:  params.Arguments.Title,
+			Format: params.Arguments.Format,
+		})
+	}
+	timeouts, err := params.Arguments.Timeouts.apply(env.Timeouts)
+	if err != nil {
+		return nil, err
+	}
 	secretKey := env.SecretKey
 	downloadPath := env.DownloadPath
 
@@ -77,7 +273,10 @@ func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTo
 		Format: format,
 	}
 
-	err = book.Download(secretKey, downloadPath)
+	result, err := book.Download(ctx, secretKey, downloadPath, &anna.DownloadOptions{
+		Progress: progressNotifier(ctx, cc, params.GetProgressToken()),
+		Timeouts: &timeouts,
+	})
 	if err != nil {
 		l.Error("Download command failed",
 			zap.String("bookHash", params.Arguments.BookHash),
@@ -86,109 +285,540 @@ func DownloadTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallTo
 		)
 		return nil, err
 	}
+	library.Record(ctx, result)
 
 	l.Info("Download command completed successfully",
 		zap.String("bookHash", params.Arguments.BookHash),
-		zap.String("downloadPath", downloadPath),
+		zap.String("path", result.Path),
+		zap.Int64("bytes", result.Bytes),
+		zap.String("md5", result.MD5),
 	)
 
-	return &mcp.CallToolResultFor[any]{
-		Content: []mcp.Content{&mcp.TextContent{
-			Text: "Book downloaded successfully to path: " + downloadPath,
-		}},
+	return &mcp.CallToolResultFor[DownloadOutput]{
+		Content: []mcp.Content{
+			&mcp.TextContent{Text: "Book downloaded successfully.\n" + result.String()},
+			fileResourceLink(result.Path, result.Bytes),
+		},
+		StructuredContent: DownloadOutput{Result: result},
 	}, nil
 }
 
-func DOITool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DOIParams]) (*mcp.CallToolResultFor[any], error) {
+func BookDetailsTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[BookDetailsParams]) (*mcp.CallToolResultFor[anna.BookDetails], error) {
+	l := logger.GetLogger()
+
+	l.Info("Book details called", zap.String("bookHash", params.Arguments.BookHash))
+
+	details, err := anna.GetBookDetails(ctx, params.Arguments.BookHash)
+	if err != nil {
+		l.Error("Book details lookup failed",
+			zap.String("bookHash", params.Arguments.BookHash),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	l.Info("Book details completed", zap.String("bookHash", params.Arguments.BookHash))
+
+	return &mcp.CallToolResultFor[anna.BookDetails]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: details.String()}},
+		StructuredContent: *details,
+	}, nil
+}
+
+func DOITool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DOIParams]) (*mcp.CallToolResultFor[anna.Paper], error) {
 	l := logger.GetLogger()
 
 	l.Info("DOI lookup called", zap.String("doi", params.Arguments.DOI))
 
-	paper, err := anna.LookupDOI(params.Arguments.DOI)
+	paper, err := anna.LookupDOI(ctx, params.Arguments.DOI)
 	if err != nil {
 		l.Error("DOI lookup failed",
 			zap.String("doi", params.Arguments.DOI),
 			zap.Error(err),
 		)
-		return &mcp.CallToolResultFor[any]{
+		return &mcp.CallToolResultFor[anna.Paper]{
 			Content: []mcp.Content{&mcp.TextContent{Text: "No paper found for DOI: " + params.Arguments.DOI}},
+			IsError: true,
 		}, nil
 	}
 
 	l.Info("DOI lookup completed", zap.String("doi", params.Arguments.DOI))
 
-	return &mcp.CallToolResultFor[any]{
-		Content: []mcp.Content{&mcp.TextContent{Text: paper.String()}},
+	return &mcp.CallToolResultFor[anna.Paper]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: paper.String()}},
+		StructuredContent: *paper,
 	}, nil
 }
 
-func DownloadPaperTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DownloadPaperParams]) (*mcp.CallToolResultFor[any], error) {
+func DownloadPaperTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DownloadPaperParams]) (*mcp.CallToolResultFor[DownloadOutput], error) {
 	l := logger.GetLogger()
 
-	l.Info("Download paper command called", zap.String("doi", params.Arguments.DOI))
+	l.Info("Download paper command called",
+		zap.String("doi", params.Arguments.DOI),
+		zap.Bool("async", params.Arguments.Async),
+	)
 
-	env, err := env.GetEnv()
+	env, err := env.FromContext(ctx)
 	if err != nil {
 		l.Error("Failed to get environment variables", zap.Error(err))
 		return nil, err
 	}
+	if err := env.RequirePaperDownload(); err != nil {
+		return nil, err
+	}
+	if params.Arguments.Async {
+		return queueDownload(ctx, &queue.Job{Kind: queue.KindPaper, DOI: params.Arguments.DOI})
+	}
+	timeouts, err := params.Arguments.Timeouts.apply(env.Timeouts)
+	if err != nil {
+		return nil, err
+	}
 
-	paper, err := anna.LookupDOI(params.Arguments.DOI)
+	result, err := anna.DownloadPaper(ctx, params.Arguments.DOI, env.OptionalSecretKey(), env.DownloadPath, &anna.DownloadOptions{
+		Progress: progressNotifier(ctx, cc, params.GetProgressToken()),
+		Timeouts: &timeouts,
+	})
 	if err != nil {
-		l.Error("DOI lookup failed for download",
+		l.Error("Download paper command failed",
 			zap.String("doi", params.Arguments.DOI),
 			zap.Error(err),
 		)
 		return nil, err
 	}
+	library.Record(ctx, result)
 
-	// Try fast_download API first if we have a hash and secret key
-	if paper.Hash != "" && env.SecretKey != "" {
-		book := &anna.Book{
-			Hash:   paper.Hash,
-			Title:  paper.Title,
-			Format: "pdf",
+	l.Info("Download paper command completed successfully",
+		zap.String("doi", params.Arguments.DOI),
+		zap.String("path", result.Path),
+	)
+
+	return &mcp.CallToolResultFor[DownloadOutput]{
+		Content: []mcp.Content{
+			&mcp.TextContent{Text: "Paper downloaded successfully.\n" + result.String()},
+			fileResourceLink(result.Path, result.Bytes),
+		},
+		StructuredContent: DownloadOutput{Result: result},
+	}, nil
+}
+
+func DownloadPapersTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DownloadPapersParams]) (*mcp.CallToolResultFor[anna.BatchReport], error) {
+	l := logger.GetLogger()
+
+	cited, err := collectCitations(params.Arguments.DOIs, params.Arguments.Bibliography)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Info("Download papers command called",
+		zap.Int("papers", len(cited)),
+		zap.Int("concurrency", params.Arguments.Concurrency),
+	)
+
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		l.Error("Failed to get environment variables", zap.Error(err))
+		return nil, err
+	}
+	if err := env.RequirePaperDownload(); err != nil {
+		return nil, err
+	}
+
+	timeouts, err := params.Arguments.Timeouts.apply(env.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &anna.BatchOptions{
+		Concurrency: params.Arguments.Concurrency,
+		Download:    &anna.DownloadOptions{Timeouts: &timeouts},
+	}
+
+	// Progress is reported per paper, as the transfers overlap
+	if token := params.GetProgressToken(); token != nil {
+		done := 0
+		opts.OnReport = func(report *anna.PaperReport) {
+			done++
+			err := cc.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
+				ProgressToken: token,
+				Progress:      float64(done),
+				Total:         float64(len(cited)),
+				Message:       report.String(),
+			})
+			if err != nil {
+				l.Warn("Failed to send progress notification", zap.Error(err))
+			}
 		}
-		if err := book.Download(env.SecretKey, env.DownloadPath); err != nil {
-			l.Warn("Fast download failed, trying SciDB download",
-				zap.String("doi", params.Arguments.DOI),
-				zap.Error(err),
-			)
-		} else {
-			l.Info("Paper downloaded via fast download",
-				zap.String("doi", params.Arguments.DOI),
-				zap.String("path", env.DownloadPath),
-			)
-			return &mcp.CallToolResultFor[any]{
-				Content: []mcp.Content{&mcp.TextContent{
-					Text: "Paper downloaded successfully to path: " + env.DownloadPath,
-				}},
-			}, nil
+	}
+
+	report := downloadCitations(ctx, env, cited, opts)
+
+	l.Info("Download papers command completed",
+		zap.Int("downloaded", report.Downloaded),
+		zap.Int("notFound", report.NotFound),
+		zap.Int("failed", report.Failed),
+		zap.Int("skipped", report.Skipped),
+	)
+
+	content := []mcp.Content{&mcp.TextContent{Text: report.String()}}
+	for _, paper := range report.Papers {
+		if paper.Result != nil {
+			content = append(content, fileResourceLink(paper.Result.Path, paper.Result.Bytes))
 		}
 	}
 
-	// Fall back to SciDB download
-	if err := paper.Download(env.DownloadPath); err != nil {
-		l.Error("SciDB download failed",
-			zap.String("doi", params.Arguments.DOI),
-			zap.Error(err),
-		)
+	return &mcp.CallToolResultFor[anna.BatchReport]{
+		Content:           content,
+		StructuredContent: *report,
+	}, nil
+}
+
+func LibrarySearchTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[LibrarySearchParams]) (*mcp.CallToolResultFor[library.EntryList], error) {
+	l := logger.GetLogger()
+
+	l.Info("Library search called", zap.String("query", params.Arguments.Query))
+
+	catalog, err := openLibrary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := catalog.Search(params.Arguments.Query)
+	if err != nil {
 		return nil, err
 	}
 
-	l.Info("Paper downloaded via SciDB",
-		zap.String("doi", params.Arguments.DOI),
-		zap.String("path", env.DownloadPath),
+	text := "No downloaded file matches the query."
+	if len(entries) > 0 {
+		parts := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			parts = append(parts, entry.String())
+		}
+		text = strings.Join(parts, "\n\n")
+	}
+
+	return &mcp.CallToolResultFor[library.EntryList]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: text}},
+		StructuredContent: library.EntryList{Entries: entries},
+	}, nil
+}
+
+func MirrorStatusTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[MirrorStatusParams]) (*mcp.CallToolResultFor[anna.MirrorReport], error) {
+	l := logger.GetLogger()
+
+	l.Info("Mirror status called")
+
+	report, err := anna.CheckMirrors(ctx)
+	if err != nil {
+		l.Error("Mirror status failed", zap.Error(err))
+		return nil, err
+	}
+
+	var text strings.Builder
+	if err := writeMirrorReport(&text, report); err != nil {
+		return nil, err
+	}
+
+	l.Info("Mirror status completed", zap.Int("mirrors", len(report.Mirrors)))
+
+	return &mcp.CallToolResultFor[anna.MirrorReport]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: text.String()}},
+		StructuredContent: *report,
+	}, nil
+}
+
+func AccountStatusTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[AccountStatusParams]) (*mcp.CallToolResultFor[anna.AccountStatus], error) {
+	l := logger.GetLogger()
+
+	l.Info("Account status called")
+
+	status, err := anna.GetAccountStatus(ctx)
+	if err != nil {
+		l.Error("Account status failed", zap.Error(err))
+		return nil, err
+	}
+
+	l.Info("Account status completed",
+		zap.Bool("known", status.Known),
+		zap.Int("downloadsLeft", status.DownloadsLeft),
 	)
 
-	return &mcp.CallToolResultFor[any]{
-		Content: []mcp.Content{&mcp.TextContent{
-			Text: "Paper downloaded successfully to path: " + env.DownloadPath,
-		}},
+	return &mcp.CallToolResultFor[anna.AccountStatus]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: status.String()}},
+		StructuredContent: *status,
+	}, nil
+}
+
+// jobListResult renders jobs as the result of the queue tools.
+func jobListResult(jobs []*queue.Job) (*mcp.CallToolResultFor[queue.JobList], error) {
+	var text strings.Builder
+	if err := writeJobs(&text, jobs); err != nil {
+		return nil, err
+	}
+
+	return &mcp.CallToolResultFor[queue.JobList]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: text.String()}},
+		StructuredContent: queue.JobList{Jobs: jobs},
 	}, nil
 }
 
-func StartMCPServer() {
+func QueueAddTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[QueueAddParams]) (*mcp.CallToolResultFor[queue.JobList], error) {
+	l := logger.GetLogger()
+
+	l.Info("Queue add called",
+		zap.Int("books", len(params.Arguments.Books)),
+		zap.Strings("dois", params.Arguments.DOIs),
+	)
+
+	jobs := make([]*queue.Job, 0, len(params.Arguments.Books)+len(params.Arguments.DOIs))
+	for _, book := range params.Arguments.Books {
+		jobs = append(jobs, &queue.Job{
+			Kind:   queue.KindBook,
+			Hash:   book.BookHash,
+			Title:  book.Title,
+			Format: book.Format,
+		})
+	}
+	for _, doi := range params.Arguments.DOIs {
+		jobs = append(jobs, &queue.Job{Kind: queue.KindPaper, DOI: doi})
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no books or DOIs given")
+	}
+
+	_, store, err := openQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	added, err := store.Add(jobs...)
+	if err != nil {
+		l.Error("Queue add failed", zap.Error(err))
+		return nil, err
+	}
+
+	l.Info("Queue add completed", zap.Int("jobs", len(added)))
+
+	return jobListResult(added)
+}
+
+func QueueListTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[QueueListParams]) (*mcp.CallToolResultFor[queue.JobList], error) {
+	_, store, err := openQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return jobListResult(filterJobs(jobs, params.Arguments.State))
+}
+
+func QueueCancelTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[QueueJobParams]) (*mcp.CallToolResultFor[queue.Job], error) {
+	l := logger.GetLogger()
+
+	l.Info("Queue cancel called", zap.String("id", params.Arguments.ID))
+
+	_, store, err := openQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	job, err := store.Cancel(params.Arguments.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mcp.CallToolResultFor[queue.Job]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: job.String()}},
+		StructuredContent: *job,
+	}, nil
+}
+
+func QueueRetryTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[QueueJobParams]) (*mcp.CallToolResultFor[queue.Job], error) {
+	l := logger.GetLogger()
+
+	l.Info("Queue retry called", zap.String("id", params.Arguments.ID))
+
+	_, store, err := openQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	job, err := store.Retry(params.Arguments.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mcp.CallToolResultFor[queue.Job]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: job.String()}},
+		StructuredContent: *job,
+	}, nil
+}
+
+func DownloadStatusTool(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[DownloadStatusParams]) (*mcp.CallToolResultFor[queue.Job], error) {
+	_, store, err := openQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	job, err := store.Get(params.Arguments.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mcp.CallToolResultFor[queue.Job]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: job.String()}},
+		StructuredContent: *job,
+	}, nil
+}
+
+// startQueueRunner downloads the queued jobs in the background until ctx is
+// cancelled, and returns a function waiting for the runner to stop. onUpdate,
+// if set, is called whenever a job ends or is queued again.
+func startQueueRunner(ctx context.Context, onUpdate func(job *queue.Job)) (wait func()) {
+	l := logger.GetLogger()
+
+	env, store, err := openQueue(ctx)
+	if err != nil {
+		l.Warn("Download queue disabled", zap.Error(err))
+		return func() {}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		queue.NewRunner(store, env, &queue.Options{OnUpdate: onUpdate}).Run(ctx)
+	}()
+	return wg.Wait
+}
+
+// Transports the MCP server can be reached through.
+const (
+	// TransportStdio serves a single client that started the server
+	TransportStdio = "stdio"
+	// TransportHTTP serves remote clients over streamable HTTP on /mcp, and
+	// over the legacy SSE transport on /sse
+	TransportHTTP = "http"
+	// TransportSSE serves remote clients over the legacy SSE transport only
+	TransportSSE = "sse"
+
+	// DefaultListenAddress only accepts local clients. Listening on other
+	// interfaces requires users, or AllowUnauthenticated.
+	DefaultListenAddress = "127.0.0.1:8080"
+
+	// shutdownTimeout is how long the HTTP server waits for the requests in
+	// flight when stopping.
+	shutdownTimeout = 5 * time.Second
+)
+
+// ServerOptions tune StartMCPServer. A nil *ServerOptions serves over stdio.
+type ServerOptions struct {
+	// Transport is one of TransportStdio, TransportHTTP and TransportSSE
+	Transport string
+	// Listen is the address the HTTP transports listen on
+	Listen string
+	// AuditLog is a file the tool calls are appended to, as JSON lines
+	AuditLog string
+	// AllowUnauthenticated lets the HTTP transports listen on interfaces
+	// other than loopback without any user configured, giving every client
+	// that can reach them the settings and files of the server
+	AllowUnauthenticated bool
+}
+
+// ValidateTransport checks that transport is one StartMCPServer supports.
+func ValidateTransport(transport string) error {
+	switch transport {
+	case TransportStdio, TransportHTTP, TransportSSE:
+		return nil
+	default:
+		return fmt.Errorf("unknown transport %q, expected %s, %s or %s", transport, TransportStdio, TransportHTTP, TransportSSE)
+	}
+}
+
+// serveHTTP serves the MCP servers of the pool to remote clients until ctx is
+// cancelled.
+func serveHTTP(ctx context.Context, pool *serverPool, listen string, allowUnauthenticated bool) error {
+	l := logger.GetLogger()
+
+	handler, users, err := newHTTPHandler(pool, listen, allowUnauthenticated)
+	if err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{
+		Addr:              listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		// Event streams stay open as long as their client, so they are
+		// closed along with ctx rather than waited for
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			l.Warn("MCP server did not stop cleanly", zap.Error(err))
+			httpServer.Close()
+		}
+	}()
+
+	l.Info("MCP server listening",
+		zap.String("transport", pool.transport),
+		zap.String("address", listen),
+		zap.Int("users", users),
+	)
+
+	err = httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+		return nil
+	}
+	return err
+}
+
+// newHTTPHandler returns the handler serving the MCP servers of the pool on
+// listen, and the number of users. When users are configured, clients
+// authenticate with a bearer token and get the server of the user the token
+// belongs to. Without users, only loopback addresses are served unless
+// allowUnauthenticated is set.
+func newHTTPHandler(pool *serverPool, listen string, allowUnauthenticated bool) (http.Handler, int, error) {
+	users, err := env.LoadUsers()
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens, err := pool.addUsers(users)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(tokens) == 0 {
+		if !isLoopback(listen) && !allowUnauthenticated {
+			return nil, 0, fmt.Errorf("refusing to serve %s without authentication: define users in the config file, listen on a loopback address such as %s, or pass --allow-unauthenticated", listen, DefaultListenAddress)
+		}
+		logger.GetLogger().Warn("No users configured, the MCP server accepts any client")
+	}
+
+	return authenticate(tokens, pool), len(tokens), nil
+}
+
+// isLoopback tells whether listen, such as "127.0.0.1:8080", only accepts
+// connections from the local host. An empty host listens on every interface.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// StartMCPServer serves the tools until ctx is cancelled or, over stdio, the
+// client disconnects. Tool calls the client cancels stop their requests and
+// downloads.
+func StartMCPServer(ctx context.Context, opts *ServerOptions) {
 	l := logger.GetLogger()
 	defer l.Sync()
 
@@ -198,29 +828,99 @@ func StartMCPServer() {
 		zap.String("version", serverVersion),
 	)
 
-	server := mcp.NewServer("annas-mcp", serverVersion, nil)
+	transport, listen, auditPath := TransportStdio, DefaultListenAddress, ""
+	allowUnauthenticated := false
+	if opts != nil {
+		if opts.Transport != "" {
+			transport = opts.Transport
+		}
+		if opts.Listen != "" {
+			listen = opts.Listen
+		}
+		auditPath = opts.AuditLog
+		allowUnauthenticated = opts.AllowUnauthenticated
+	}
 
-	server.AddTools(
-		mcp.NewServerTool("search", "Search Anna's Archive. Set content to 'book_any' to search books (default), or 'journal' to search journal articles and academic papers. When the user asks for papers or articles, use content=journal. To find a specific paper by DOI, use the doi tool instead.", SearchTool, mcp.Input(
+	audit, err := openAuditLog(auditPath)
+	if err != nil {
+		l.Fatal("Failed to open the audit log", zap.Error(err))
+	}
+	defer audit.Close()
+
+	// Queued downloads run as long as the server does
+	runnerCtx, stopRunners := context.WithCancel(ctx)
+	pool := newServerPool(runnerCtx, transport, audit)
+
+	if transport == TransportStdio {
+		err = pool.get("").server.Run(ctx, mcp.NewStdioTransport())
+	} else {
+		err = serveHTTP(ctx, pool, listen, allowUnauthenticated)
+	}
+	stopRunners()
+	pool.wait()
+	if err != nil {
+		l.Fatal("MCP server failed", zap.Error(err))
+	}
+}
+
+// serverTools returns the tools of the MCP server.
+func serverTools() []*mcp.ServerTool {
+	return []*mcp.ServerTool{
+		newStructuredTool("search", "Search Anna's Archive. Set content to 'book_any' to search books (default), or 'journal' to search journal articles and academic papers.", SearchTool, mcp.Input(
 			mcp.Property("term", mcp.Description("Search query (e.g. book title, author, topic, or paper keywords)")),
 			mcp.Property("content", mcp.Description("Content type: 'book_any' for books (default), 'journal' for academic papers and articles")),
+			mcp.Property("page", mcp.Description("Results page to fetch, starting at 1 (default). The response says whether more pages exist.")),
+			mcp.Property("language", mcp.Description("Only return documents in these languages, as codes (e.g. ['en', 'de'])")),
+			mcp.Property("extension", mcp.Description("Only return these file types (e.g. ['epub', 'pdf'])")),
+			mcp.Property("source", mcp.Description("Only return documents from these source libraries (e.g. ['lgli', 'lgrs', 'zlib', 'ia'])")),
+			mcp.Property("year_from", mcp.Description("Only return documents published in or after this year. The site cannot filter by year, so each page is filtered after it is fetched: a page may have few or no results while has_more is true, in which case fetch the next page")),
+			mcp.Property("year_to", mcp.Description("Only return documents published in or before this year. The site cannot filter by year, so each page is filtered after it is fetched: a page may have few or no results while has_more is true, in which case fetch the next page")),
+			mcp.Property("sort", mcp.Description("Sort order of the results: newest and oldest by publication year, newest_added and oldest_added by when Anna's Archive got the file"), mcp.Enum("relevant", "newest", "oldest", "largest", "smallest", "newest_added", "oldest_added")),
 		)),
-		mcp.NewServerTool("download", "Download a book by its MD5 hash. Requires ANNAS_SECRET_KEY and ANNAS_DOWNLOAD_PATH environment variables.", DownloadTool, mcp.Input(
+		newStructuredTool("download", "Download a book by its MD5 hash. The file is verified against the hash and rejected if it does not match. Large files may take longer than the tool call is allowed to: set async to get a job ID right away and follow it with download_status. Requires ANNAS_SECRET_KEY (an Anna's Archive membership key) and ANNAS_DOWNLOAD_PATH.", DownloadTool, mcp.Input(
 			mcp.Property("hash", mcp.Description("MD5 hash of the book to download")),
 			mcp.Property("title", mcp.Description("Book title, used for filename")),
 			mcp.Property("format", mcp.Description("Book format, for example pdf or epub")),
+			mcp.Property("async", mcp.Description("Download in the background and return a job ID right away, instead of waiting for the file")),
+			mcp.Property("timeouts", mcp.Description("Timeouts replacing the configured ones for this download, each a duration such as '90s' or a number of seconds: connect, response_header, idle (without receiving data) and total (0 for no limit). Background downloads use the configured timeouts.")),
 		)),
-		mcp.NewServerTool("doi", "Look up a specific journal article by its DOI via SciDB. Returns authors, journal, size, and download links. If you don't have a DOI and the user wants to find papers by topic or keyword, use the search tool with content=journal instead.", DOITool, mcp.Input(
+		newStructuredTool("book_details", "Get the full record of a book by its MD5 hash: ISBNs, year, edition, series, description, cover, alternative titles and authors, exact file size, collections, download mirrors and other file versions.", BookDetailsTool, mcp.Input(
+			mcp.Property("hash", mcp.Description("MD5 hash of the book, as returned by the search tool")),
+		)),
+		newStructuredTool("doi", "Look up a specific journal article by its DOI via SciDB. Returns authors, journal, size, and download links.", DOITool, mcp.Input(
 			mcp.Property("doi", mcp.Description("DOI of the paper (e.g. 10.1038/nature12345)")),
 		)),
-		mcp.NewServerTool("download_paper", "Download a journal article/paper by its DOI. Looks up the paper, then downloads via fast download (if available) or SciDB. Requires ANNAS_DOWNLOAD_PATH environment variable.", DownloadPaperTool, mcp.Input(
+		newStructuredTool("download_paper", "Download a journal article/paper by its DOI. Looks up the paper, then downloads via fast download (if ANNAS_SECRET_KEY is set) or SciDB. Set async to get a job ID right away and follow it with download_status. Requires ANNAS_DOWNLOAD_PATH.", DownloadPaperTool, mcp.Input(
 			mcp.Property("doi", mcp.Description("DOI of the paper to download (e.g. 10.1038/nature12345)")),
+			mcp.Property("async", mcp.Description("Download in the background and return a job ID right away, instead of waiting for the file")),
+			mcp.Property("timeouts", mcp.Description("Timeouts replacing the configured ones for this download, each a duration such as '90s' or a number of seconds: connect, response_header, idle (without receiving data) and total (0 for no limit). Background downloads use the configured timeouts.")),
 		)),
-	)
-
-	l.Info("MCP server started successfully")
-
-	if err := server.Run(context.Background(), mcp.NewStdioTransport()); err != nil {
-		l.Fatal("MCP server failed", zap.Error(err))
+		newStructuredTool("download_status", "Get the state of a background download started with async or queue_add: its progress while running, the downloaded file once done, or the error it failed with. Use queue_list to list all of them.", DownloadStatusTool, mcp.Input(
+			mcp.Property("id", mcp.Description("ID of the job, as returned by download, download_paper or queue_add")),
+		)),
+		newStructuredTool("download_papers", "Download several papers at once, given as DOIs or as a bibliography (BibTeX or RIS, such as a Zotero export, or any text containing DOIs). Each paper is downloaded like download_paper does, a few at a time, and the outcome of each one is reported: downloaded with its path, not found, failed with the reason, or skipped for lack of a DOI. Requires ANNAS_DOWNLOAD_PATH.", DownloadPapersTool, mcp.Input(
+			mcp.Property("dois", mcp.Description("DOIs of the papers to download (e.g. ['10.1038/nature12345'])")),
+			mcp.Property("bibliography", mcp.Description("Content of a BibTeX or RIS bibliography, or any text containing DOIs")),
+			mcp.Property("concurrency", mcp.Description("Number of papers to download at the same time (default 3, at most 8)")),
+			mcp.Property("timeouts", mcp.Description("Timeouts replacing the configured ones for every download, each a duration such as '90s' or a number of seconds: connect, response_header, idle (without receiving data) and total (0 for no limit).")),
+		)),
+		newStructuredTool("account_status", "Get how many fast downloads the account has left today. Requires ANNAS_SECRET_KEY.", AccountStatusTool),
+		newStructuredTool("queue_add", "Queue books and papers to be downloaded in the background, several at a time, with retries. Returns a job ID for each one right away.", QueueAddTool, mcp.Input(
+			mcp.Property("books", mcp.Description("Books to download, each with the hash, title and format returned by the search tool")),
+			mcp.Property("dois", mcp.Description("DOIs of papers to download (e.g. ['10.1038/nature12345'])")),
+		)),
+		newStructuredTool("queue_list", "List the jobs of the download queue, including the downloads started with async, with their state (queued, running, done, failed or cancelled), progress, downloaded file or error.", QueueListTool, mcp.Input(
+			mcp.Property("state", mcp.Description("Only list jobs in this state"), mcp.Enum("queued", "running", "done", "failed", "cancelled")),
+		)),
+		newStructuredTool("queue_cancel", "Cancel a queued or running download job.", QueueCancelTool, mcp.Input(
+			mcp.Property("id", mcp.Description("ID of the job, as returned by queue_add")),
+		)),
+		newStructuredTool("queue_retry", "Queue a failed or cancelled download job again.", QueueRetryTool, mcp.Input(
+			mcp.Property("id", mcp.Description("ID of the job, as returned by queue_add")),
+		)),
+		newStructuredTool("library_search", "Search the files downloaded so far by title, authors, DOI or MD5 hash, to tell whether a book or paper was already downloaded and where it is. Files moved or deleted since are marked as missing. An empty query lists every download, most recent first.", LibrarySearchTool, mcp.Input(
+			mcp.Property("query", mcp.Description("Words to look for, all of which must match (e.g. 'deep learning goodfellow', a DOI or an MD5 hash)")),
+		)),
+		newStructuredTool("mirror_status", "Check every configured Anna's Archive mirror: whether the search page loads and how fast, whether the fast download API answers, and whether the page layout is the one this server understands. Use it when searches or downloads fail.", MirrorStatusTool),
 	}
 }
@@ -0,0 +1,158 @@
+package modes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.0.0.2:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"192.168.1.10:8080", false},
+		{"example.com:8080", false},
+		{"127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isLoopback(tt.listen); got != tt.want {
+			t.Errorf("isLoopback(%q) = %v, want %v", tt.listen, got, tt.want)
+		}
+	}
+}
+
+// setupServerEnv points the settings and state of the server at temporary
+// folders, with config as the config file.
+func setupServerEnv(t *testing.T, config string) {
+	t.Helper()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ANNAS_CONFIG", configPath)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	t.Setenv("ANNAS_DOWNLOAD_PATH", filepath.Join(dir, "downloads"))
+	t.Setenv("ANNAS_PROFILE", "")
+	t.Setenv("ANNAS_SECRET_KEY", "")
+}
+
+func newTestPool(t *testing.T) *serverPool {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := newServerPool(ctx, TransportHTTP, nil)
+	t.Cleanup(func() {
+		cancel()
+		pool.wait()
+	})
+	return pool
+}
+
+// postInitialize sends an MCP initialize request with the Authorization
+// header, if any, and returns the status code of the answer.
+func postInitialize(t *testing.T, url, authorization string) int {
+	t.Helper()
+	body := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-06-18","capabilities":{},"clientInfo":{"name":"test","version":"1"}}}`
+	req, err := http.NewRequest(http.MethodPost, url+"/mcp", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHTTPHandlerWithoutUsers(t *testing.T) {
+	tests := []struct {
+		name                 string
+		listen               string
+		allowUnauthenticated bool
+		wantErr              bool
+	}{
+		{name: "loopback", listen: "127.0.0.1:8080"},
+		{name: "every interface", listen: ":8080", wantErr: true},
+		{name: "public address", listen: "0.0.0.0:8080", wantErr: true},
+		{name: "public address allowed", listen: "0.0.0.0:8080", allowUnauthenticated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupServerEnv(t, "")
+
+			handler, users, err := newHTTPHandler(newTestPool(t), tt.listen, tt.allowUnauthenticated)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "--allow-unauthenticated") {
+					t.Fatalf("newHTTPHandler() error = %v, want a refusal", err)
+				}
+				return
+			}
+			if err != nil || users != 0 {
+				t.Fatalf("newHTTPHandler() = %d users, %v", users, err)
+			}
+
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			if status := postInitialize(t, server.URL, ""); status != http.StatusOK {
+				t.Errorf("unauthenticated request answered with %d, want %d", status, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestHTTPHandlerWithUsers(t *testing.T) {
+	setupServerEnv(t, fmt.Sprintf(`
+[profiles.lab]
+download_path = %q
+
+[users.alice]
+token = "alice-token"
+profile = "lab"
+`, t.TempDir()))
+
+	// With users, any address is served, but only to them
+	handler, users, err := newHTTPHandler(newTestPool(t), "0.0.0.0:8080", false)
+	if err != nil || users != 1 {
+		t.Fatalf("newHTTPHandler() = %d users, %v, want 1 user", users, err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer bob-token", http.StatusUnauthorized},
+		{"Basic alice-token", http.StatusUnauthorized},
+		{"Bearer alice-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if status := postInitialize(t, server.URL, tt.authorization); status != tt.want {
+			t.Errorf("request with Authorization %q answered with %d, want %d", tt.authorization, status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package modes
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"github.com/iosifache/annas-mcp/internal/queue"
+	"github.com/iosifache/annas-mcp/internal/version"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"go.uber.org/zap"
+)
+
+// userServer is the MCP server of a single user, with the HTTP handler
+// serving it.
+type userServer struct {
+	server  *mcp.Server
+	handler http.Handler
+}
+
+// serverPool builds an MCP server for every user, so that their sessions,
+// settings and download queues are kept apart. The anonymous user "" has no
+// settings of its own, and reads the ones of the selected profile on every
+// call, like the CLI does.
+type serverPool struct {
+	// ctx bounds the download queue runners of the servers
+	ctx       context.Context
+	transport string
+	audit     *auditLog
+
+	mu      sync.Mutex
+	envs    map[string]*env.Env
+	servers map[string]*userServer
+	runners []func()
+}
+
+func newServerPool(ctx context.Context, transport string, audit *auditLog) *serverPool {
+	return &serverPool{
+		ctx:       ctx,
+		transport: transport,
+		audit:     audit,
+		envs:      make(map[string]*env.Env),
+		servers:   make(map[string]*userServer),
+	}
+}
+
+// addUsers loads the settings of the users, and returns the users by token.
+func (p *serverPool) addUsers(users map[string]*env.User) (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tokens := make(map[string]string, len(users))
+	for name, user := range users {
+		e, err := env.GetUserEnv(name, user)
+		if err != nil {
+			return nil, err
+		}
+		p.envs[name] = e
+		tokens[user.Token] = name
+	}
+	return tokens, nil
+}
+
+// get returns the server of the named user, and starts it on first use.
+func (p *serverPool) get(user string) *userServer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.servers[user]; ok {
+		return s
+	}
+
+	e := p.envs[user]
+	userCtx := p.ctx
+	if e != nil {
+		userCtx = env.WithEnv(userCtx, e)
+	}
+
+	server := mcp.NewServer("annas-mcp", version.GetVersion(), nil)
+	files := newFolderResources(server)
+	// The SDK resolves the schemas of the tools in place, so every server
+	// needs tools of its own
+	for _, tool := range serverTools() {
+		server.AddTools(p.withUser(tool, user, e, files))
+	}
+	server.AddPrompts(serverPrompts()...)
+	for _, template := range resourceTemplates() {
+		template.Handler = withUserResource(template.Handler, e)
+		server.AddResourceTemplates(template)
+	}
+	files.sync(userCtx)
+
+	s := &userServer{server: server}
+	if p.transport != TransportStdio {
+		getServer := func(*http.Request) *mcp.Server { return server }
+		mux := http.NewServeMux()
+		if p.transport == TransportHTTP {
+			mux.Handle("/mcp", mcp.NewStreamableHTTPHandler(getServer, nil))
+		}
+		mux.Handle("/sse", mcp.NewSSEHandler(getServer))
+		s.handler = mux
+	}
+
+	p.runners = append(p.runners, startQueueRunner(userCtx, func(job *queue.Job) {
+		if job.State == queue.StateDone {
+			files.sync(userCtx)
+		}
+	}))
+
+	logger.GetLogger().Info("MCP server started successfully", zap.String("user", user))
+
+	p.servers[user] = s
+	return s
+}
+
+// wait waits for the download queue runners to stop.
+func (p *serverPool) wait() {
+	p.mu.Lock()
+	runners := p.runners
+	p.mu.Unlock()
+
+	for _, wait := range runners {
+		wait()
+	}
+}
+
+// withUser runs tool with the settings of the user, if any, and records each
+// call in the audit log. Files the call downloaded are then published as
+// resources.
+func (p *serverPool) withUser(tool *mcp.ServerTool, user string, e *env.Env, files *folderResources) *mcp.ServerTool {
+	handler := tool.Handler
+	return &mcp.ServerTool{
+		Tool: tool.Tool,
+		Handler: func(ctx context.Context, cc *mcp.ServerSession, params *mcp.CallToolParamsFor[map[string]any]) (*mcp.CallToolResult, error) {
+			if e != nil {
+				ctx = env.WithEnv(ctx, e)
+			}
+
+			start := time.Now()
+			res, err := handler(ctx, cc, params)
+			p.audit.record(&auditEntry{
+				Time:      start.UTC(),
+				User:      user,
+				Tool:      params.Name,
+				Arguments: params.Arguments,
+				Duration:  time.Since(start).Milliseconds(),
+				Error:     callError(res, err),
+			})
+			if err == nil {
+				files.sync(ctx)
+			}
+			return res, err
+		},
+	}
+}
+
+// withUserResource reads a resource with the settings of the user, if any,
+// such as their mirrors, rather than the ones of the server.
+func withUserResource(handler mcp.ResourceHandler, e *env.Env) mcp.ResourceHandler {
+	if e == nil {
+		return handler
+	}
+	return func(ctx context.Context, ss *mcp.ServerSession, params *mcp.ReadResourceParams) (*mcp.ReadResourceResult, error) {
+		return handler(env.WithEnv(ctx, e), ss, params)
+	}
+}
+
+// callError returns the reason a tool call failed, or an empty string if it
+// did not.
+func callError(res *mcp.CallToolResult, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if res == nil || !res.IsError {
+		return ""
+	}
+	for _, content := range res.Content {
+		if text, ok := content.(*mcp.TextContent); ok {
+			return text.Text
+		}
+	}
+	return "tool call failed"
+}
+
+// authenticate dispatches requests to the server of the user their bearer
+// token belongs to. Without any token, every request goes to the anonymous
+// user.
+func authenticate(tokens map[string]string, pool *serverPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(tokens) == 0 {
+			pool.get("").handler.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := tokenUser(tokens, r.Header.Get("Authorization"))
+		if !ok {
+			logger.GetLogger().Warn("Rejected unauthenticated request",
+				zap.String("remoteAddr", r.RemoteAddr),
+				zap.String("path", r.URL.Path),
+			)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="annas-mcp"`)
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		pool.get(user).handler.ServeHTTP(w, r)
+	})
+}
+
+// tokenUser returns the user whose token is in the Authorization header. All
+// the tokens are compared in constant time, so that the timing of the answer
+// does not tell how close a guess was.
+func tokenUser(tokens map[string]string, header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+
+	user, found := "", false
+	for candidate, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			user, found = name, true
+		}
+	}
+	return user, found
+}
+
+// auditEntry is a tool call, as recorded in the audit log.
+type auditEntry struct {
+	Time      time.Time      `json:"time"`
+	User      string         `json:"user,omitempty"`
+	Tool      string         `json:"tool"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+	// Duration is in milliseconds
+	Duration int64  `json:"duration_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+// auditLog records who called which tool, in the server log and, if a file
+// is set, as JSON lines appended to it.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens the audit log file at path, which may be empty to only
+// record the calls in the server log.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return &auditLog{}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &auditLog{file: file}, nil
+}
+
+func (a *auditLog) record(entry *auditEntry) {
+	l := logger.GetLogger()
+	l.Info("Tool called",
+		zap.String("user", entry.User),
+		zap.String("tool", entry.Tool),
+		zap.Int64("durationMs", entry.Duration),
+		zap.String("error", entry.Error),
+	)
+
+	if a.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		l.Error("Failed to encode audit log entry", zap.Error(err))
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		l.Error("Failed to write audit log entry", zap.Error(err))
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,42 @@
+package modes
+
+import "testing"
+
+func TestTokenUser(t *testing.T) {
+	tokens := map[string]string{
+		"alice-token": "alice",
+		"bob-token":   "bob",
+	}
+
+	tests := []struct {
+		name     string
+		header   string
+		wantUser string
+		wantOK   bool
+	}{
+		{name: "valid token", header: "Bearer alice-token", wantUser: "alice", wantOK: true},
+		{name: "scheme in lower case", header: "bearer bob-token", wantUser: "bob", wantOK: true},
+		{name: "surrounding spaces", header: "Bearer  alice-token ", wantUser: "alice", wantOK: true},
+		{name: "missing header", header: ""},
+		{name: "scheme only", header: "Bearer"},
+		{name: "empty token", header: "Bearer "},
+		{name: "token without scheme", header: "alice-token"},
+		{name: "wrong scheme", header: "Basic alice-token"},
+		{name: "unknown token", header: "Bearer carol-token"},
+		{name: "prefix of a token", header: "Bearer alice"},
+		{name: "token with a suffix", header: "Bearer alice-token2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, ok := tokenUser(tokens, tt.header)
+			if user != tt.wantUser || ok != tt.wantOK {
+				t.Errorf("tokenUser(%q) = %q, %v, want %q, %v", tt.header, user, ok, tt.wantUser, tt.wantOK)
+			}
+		})
+	}
+
+	if user, ok := tokenUser(map[string]string{}, "Bearer "); ok {
+		t.Errorf("tokenUser() without tokens = %q, want no user", user)
+	}
+}
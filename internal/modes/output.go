@@ -0,0 +1,293 @@
+package modes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+	"github.com/iosifache/annas-mcp/internal/library"
+	"github.com/iosifache/annas-mcp/internal/queue"
+)
+
+const (
+	outputText  = "text"
+	outputJSON  = "json"
+	outputJSONL = "jsonl"
+	outputCSV   = "csv"
+	outputTSV   = "tsv"
+	outputTable = "table"
+)
+
+var outputFormats = []string{outputText, outputJSON, outputJSONL, outputCSV, outputTSV, outputTable}
+
+// Columns written by the CSV and TSV outputs
+var bookColumns = []string{"hash", "title", "authors", "publisher", "year", "language", "format", "content_type", "size", "size_bytes", "collections", "url"}
+
+func validateOutputFormat(format string) error {
+	for _, f := range outputFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported output format %q, expected one of: %s", format, strings.Join(outputFormats, ", "))
+}
+
+func writeSearchResult(w io.Writer, format string, result *anna.SearchResult) error {
+	switch format {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case outputJSONL:
+		encoder := json.NewEncoder(w)
+		for _, book := range result.Books {
+			if err := encoder.Encode(book); err != nil {
+				return err
+			}
+		}
+		return nil
+	case outputCSV, outputTSV:
+		return writeBooksCSV(w, format, result.Books)
+	case outputTable:
+		return writeBooksTable(w, result)
+	default:
+		return writeBooksText(w, result)
+	}
+}
+
+// writeNoBooks reports an empty page of results. With year filters, which
+// are applied to each page, an empty page may still be followed by others.
+func writeNoBooks(w io.Writer, result *anna.SearchResult) error {
+	if result.HasMore {
+		_, err := fmt.Fprintf(w, "No matches on this page, use --page %d to see the next page.\n", result.Page+1)
+		return err
+	}
+	_, err := fmt.Fprintln(w, "No books found.")
+	return err
+}
+
+func writeBooksText(w io.Writer, result *anna.SearchResult) error {
+	books := result.Books
+	if len(books) == 0 {
+		return writeNoBooks(w, result)
+	}
+
+	for i, book := range books {
+		fmt.Fprintf(w, "Book %d:\n%s\n", i+1, book.String())
+		if i < len(books)-1 {
+			fmt.Fprintln(w)
+		}
+	}
+
+	if result.HasMore {
+		fmt.Fprintf(w, "\nMore results available, use --page %d to see the next page.\n", result.Page+1)
+	}
+
+	return nil
+}
+
+func writeBooksCSV(w io.Writer, format string, books []*anna.Book) error {
+	writer := csv.NewWriter(w)
+	if format == outputTSV {
+		writer.Comma = '\t'
+	}
+
+	if err := writer.Write(bookColumns); err != nil {
+		return err
+	}
+	for _, book := range books {
+		if err := writer.Write(bookRow(book)); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeBooksTable(w io.Writer, result *anna.SearchResult) error {
+	if len(result.Books) == 0 {
+		return writeNoBooks(w, result)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HASH\tTITLE\tAUTHORS\tYEAR\tLANGUAGE\tFORMAT\tSIZE")
+	for _, book := range result.Books {
+		year := ""
+		if book.Year != 0 {
+			year = strconv.Itoa(book.Year)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			book.Hash, truncate(book.Title, 60), truncate(book.Authors, 30), year, book.Language, book.Format, book.Size)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if result.HasMore {
+		fmt.Fprintf(w, "\nMore results available, use --page %d to see the next page.\n", result.Page+1)
+	}
+
+	return nil
+}
+
+func bookRow(book *anna.Book) []string {
+	year := ""
+	if book.Year != 0 {
+		year = strconv.Itoa(book.Year)
+	}
+
+	return []string{
+		book.Hash,
+		book.Title,
+		book.Authors,
+		book.Publisher,
+		year,
+		book.Language,
+		book.Format,
+		book.ContentType,
+		book.Size,
+		strconv.FormatInt(book.SizeBytes, 10),
+		strings.Join(book.Collections, "/"),
+		book.URL,
+	}
+}
+
+func writeMirrorReport(w io.Writer, report *anna.MirrorReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MIRROR\tSEARCH\tLATENCY\tFAST DOWNLOAD\tLAYOUT\tFINGERPRINT\tERROR")
+	for _, status := range report.Mirrors {
+		search := "down"
+		if status.Reachable {
+			search = "ok"
+		}
+		if status.StatusCode != 0 {
+			search += fmt.Sprintf(" (%d)", status.StatusCode)
+		}
+		fastDownload := okOrFail(status.FastDownloadAPI)
+		if status.FastDownloadAPISkipped {
+			fastDownload = "skipped (no key)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%dms\t%s\t%s\t%s\t%s\n",
+			status.Mirror, search, status.LatencyMS, fastDownload, okOrFail(status.LayoutOK), status.Fingerprint, truncate(status.Error, 60))
+	}
+	return tw.Flush()
+}
+
+func writeJobs(w io.Writer, jobs []*queue.Job) error {
+	if len(jobs) == 0 {
+		_, err := fmt.Fprintln(w, "The queue is empty.")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tATTEMPTS\tTARGET\tDETAILS")
+	for _, job := range jobs {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n",
+			job.ID, job.State, job.Attempts, truncate(job.Target(), 70), truncate(jobDetails(job), 70))
+	}
+	return tw.Flush()
+}
+
+// jobDetails summarizes the progress or outcome of a job.
+func jobDetails(job *queue.Job) string {
+	switch {
+	case job.Result != nil:
+		return job.Result.Path
+	case job.State == queue.StateRunning && job.BytesTotal > 0:
+		return fmt.Sprintf("%s of %s", formatBytes(job.BytesDone), formatBytes(job.BytesTotal))
+	case job.State == queue.StateRunning && job.BytesDone > 0:
+		return formatBytes(job.BytesDone)
+	case job.State == queue.StateQueued && job.Error != "" && time.Now().Before(job.NextAttemptAt):
+		return fmt.Sprintf("retry at %s: %s", job.NextAttemptAt.Local().Format(time.TimeOnly), job.Error)
+	default:
+		return job.Error
+	}
+}
+
+// Columns written by the CSV export of the library
+var libraryColumns = []string{"md5", "hash", "doi", "title", "authors", "format", "size", "path", "source", "mirror", "verified", "downloaded_at", "missing"}
+
+func writeLibrary(w io.Writer, format string, entries []*library.Entry) error {
+	switch format {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case outputCSV:
+		return writeLibraryCSV(w, entries)
+	default:
+		return writeLibraryTable(w, entries)
+	}
+}
+
+func writeLibraryTable(w io.Writer, entries []*library.Entry) error {
+	if len(entries) == 0 {
+		_, err := fmt.Fprintln(w, "No downloads found.")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MD5\tDOWNLOADED\tFORMAT\tSIZE\tTITLE\tDOI")
+	for _, entry := range entries {
+		title := entry.Title
+		if entry.Missing {
+			title += " (missing)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.MD5, entry.DownloadedAt.Local().Format(time.DateOnly), entry.Format, formatBytes(entry.Size), truncate(title, 60), entry.DOI)
+	}
+	return tw.Flush()
+}
+
+func writeLibraryCSV(w io.Writer, entries []*library.Entry) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(libraryColumns); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := writer.Write([]string{
+			entry.MD5,
+			entry.Hash,
+			entry.DOI,
+			entry.Title,
+			entry.Authors,
+			entry.Format,
+			strconv.FormatInt(entry.Size, 10),
+			entry.Path,
+			entry.Source,
+			entry.Mirror,
+			strconv.FormatBool(entry.Verified),
+			entry.DownloadedAt.Format(time.RFC3339),
+			strconv.FormatBool(entry.Missing),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func okOrFail(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "fail"
+}
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(s), " "))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,188 @@
+package modes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+	"github.com/iosifache/annas-mcp/internal/citations"
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/library"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// collectCitations gathers the papers given as DOIs and in a bibliography,
+// such as a BibTeX or RIS export or a plain list.
+func collectCitations(dois []string, bibliography string) ([]citations.Citation, error) {
+	var collected []citations.Citation
+	for _, arg := range dois {
+		doi := citations.NormalizeDOI(arg)
+		if doi == "" {
+			return nil, fmt.Errorf("not a DOI: %s", arg)
+		}
+		collected = append(collected, citations.Citation{DOI: doi})
+	}
+	collected = append(collected, citations.Parse(bibliography)...)
+
+	collected = citations.Dedupe(collected)
+	if len(collected) == 0 {
+		return nil, fmt.Errorf("no DOIs given")
+	}
+	return collected, nil
+}
+
+// downloadCitations downloads the papers that have a DOI, adding them to the
+// library as they are done, and reports the others as skipped, keeping the
+// order of the citations.
+func downloadCitations(ctx context.Context, env *env.Env, cited []citations.Citation, opts *anna.BatchOptions) *anna.BatchReport {
+	var dois []string
+	for _, citation := range cited {
+		if citation.DOI != "" {
+			dois = append(dois, citation.DOI)
+		}
+	}
+
+	batchOpts := anna.BatchOptions{}
+	if opts != nil {
+		batchOpts = *opts
+	}
+	onReport := batchOpts.OnReport
+	batchOpts.OnReport = func(report *anna.PaperReport) {
+		if report.Result != nil {
+			library.Record(ctx, report.Result)
+		}
+		if onReport != nil {
+			onReport(report)
+		}
+	}
+	downloaded := anna.DownloadPapers(ctx, dois, env.OptionalSecretKey(), env.DownloadPath, &batchOpts)
+
+	report := &anna.BatchReport{}
+	for _, citation := range cited {
+		if citation.DOI == "" {
+			title := citation.Title
+			if title == "" {
+				title = citation.Key
+			}
+			report.Add(&anna.PaperReport{Title: title, Status: anna.PaperSkipped})
+			continue
+		}
+		paper := downloaded.Papers[0]
+		downloaded.Papers = downloaded.Papers[1:]
+		paper.Title = citation.Title
+		report.Add(paper)
+	}
+	return report
+}
+
+// readBibliography reads a bibliography file, or standard input for "-".
+func readBibliography(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	if path == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		return string(data), err
+	}
+	data, err := os.ReadFile(path)
+	return string(data), err
+}
+
+func newPapersCmd() *cobra.Command {
+	l := logger.GetLogger()
+
+	papersCmd := &cobra.Command{
+		Use:   "papers",
+		Short: "Work with several papers at once",
+	}
+
+	downloadCmd := &cobra.Command{
+		Use:   "download [doi...]",
+		Short: "Download papers by their DOIs or from a bibliography",
+		Long:  "Download papers given as DOIs, or listed in a file: a BibTeX or RIS export, such as one from Zotero, or any text containing DOIs. Each paper is looked up and downloaded like the download_paper tool does, a few at a time, and the outcome of each one is reported. Requires ANNAS_DOWNLOAD_PATH.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if file, _ := cmd.Flags().GetString("file"); file == "" && len(args) == 0 {
+				return fmt.Errorf("give DOIs as arguments or a bibliography with --file")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, _ := cmd.Flags().GetString("file")
+			concurrency, _ := cmd.Flags().GetInt("concurrency")
+			output, _ := cmd.Flags().GetString("output")
+			if output != outputText && output != outputJSON {
+				return fmt.Errorf("unsupported output format %q, expected one of: %s, %s", output, outputText, outputJSON)
+			}
+
+			bibliography, err := readBibliography(file)
+			if err != nil {
+				return fmt.Errorf("failed to read bibliography: %w", err)
+			}
+			cited, err := collectCitations(args, bibliography)
+			if err != nil {
+				return err
+			}
+
+			l.Info("Papers download command called",
+				zap.Int("papers", len(cited)),
+				zap.String("file", file),
+				zap.Int("concurrency", concurrency),
+			)
+
+			env, err := env.GetEnv()
+			if err != nil {
+				return fmt.Errorf("failed to get environment: %w", err)
+			}
+			if err := env.RequirePaperDownload(); err != nil {
+				return err
+			}
+
+			timeouts := timeoutFlags(cmd, env.Timeouts)
+			opts := &anna.BatchOptions{
+				Concurrency: concurrency,
+				Download:    &anna.DownloadOptions{Timeouts: &timeouts},
+			}
+			if output == outputText {
+				opts.OnReport = func(report *anna.PaperReport) {
+					fmt.Fprintln(os.Stderr, report.String())
+				}
+			}
+			report := downloadCitations(cmd.Context(), env, cited, opts)
+
+			if output == outputJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(report); err != nil {
+					return fmt.Errorf("failed to write report: %w", err)
+				}
+			} else {
+				fmt.Println(report.String())
+			}
+
+			l.Info("Papers download command completed",
+				zap.Int("downloaded", report.Downloaded),
+				zap.Int("notFound", report.NotFound),
+				zap.Int("failed", report.Failed),
+				zap.Int("skipped", report.Skipped),
+			)
+
+			if missing := len(report.Papers) - report.Downloaded; missing > 0 {
+				return fmt.Errorf("%d of %d papers were not downloaded", missing, len(report.Papers))
+			}
+			return nil
+		},
+	}
+	downloadCmd.Flags().StringP("file", "f", "", "BibTeX, RIS or text file listing the papers, or - for standard input")
+	downloadCmd.Flags().Int("concurrency", anna.DefaultBatchConcurrency, fmt.Sprintf("Number of papers to download at the same time, at most %d", anna.MaxBatchConcurrency))
+	downloadCmd.Flags().StringP("output", "o", outputText, "Output format: text or json")
+	addTimeoutFlags(downloadCmd)
+
+	papersCmd.AddCommand(downloadCmd)
+
+	return papersCmd
+}
@@ -1,14 +1,27 @@
 package modes
 
 type SearchParams struct {
-	SearchTerm string `json:"term" mcp:"Term to search for"`
-	Content    string `json:"content" mcp:"Content type filter: book_any (default) for books, journal for papers/articles"`
+	SearchTerm string   `json:"term" mcp:"Term to search for"`
+	Content    string   `json:"content" mcp:"Content type filter: book_any (default) for books, journal for papers/articles"`
+	Page       int      `json:"page,omitempty" mcp:"Results page to fetch, starting at 1"`
+	Language   []string `json:"language,omitempty" mcp:"Language codes to keep, for example en or de"`
+	Extension  []string `json:"extension,omitempty" mcp:"File extensions to keep, for example epub or pdf"`
+	Source     []string `json:"source,omitempty" mcp:"Source libraries to keep, for example lgli, lgrs, zlib or ia"`
+	YearFrom   int      `json:"year_from,omitempty" mcp:"Earliest publication year. Applied to each page of results, so pages may be short or empty while has_more is true: keep paging"`
+	YearTo     int      `json:"year_to,omitempty" mcp:"Latest publication year. Applied to each page of results, so pages may be short or empty while has_more is true: keep paging"`
+	Sort       string   `json:"sort,omitempty" mcp:"Sort order: relevant (default), newest, oldest, largest, smallest, newest_added or oldest_added"`
 }
 
 type DownloadParams struct {
-	BookHash string `json:"hash" mcp:"MD5 hash of the book to download"`
-	Title    string `json:"title" mcp:"Book title, used for filename"`
-	Format   string `json:"format" mcp:"Book format, for example pdf or epub"`
+	BookHash string         `json:"hash" mcp:"MD5 hash of the book to download"`
+	Title    string         `json:"title" mcp:"Book title, used for filename"`
+	Format   string         `json:"format" mcp:"Book format, for example pdf or epub"`
+	Async    bool           `json:"async,omitempty" mcp:"Queue the download and return a job ID right away"`
+	Timeouts *TimeoutParams `json:"timeouts,omitempty" mcp:"Timeouts replacing the configured ones for this download"`
+}
+
+type BookDetailsParams struct {
+	BookHash string `json:"hash" mcp:"MD5 hash of the book to look up"`
 }
 
 type DOIParams struct {
@@ -16,5 +29,52 @@ type DOIParams struct {
 }
 
 type DownloadPaperParams struct {
-	DOI string `json:"doi" mcp:"DOI of the paper to download"`
+	DOI      string         `json:"doi" mcp:"DOI of the paper to download"`
+	Async    bool           `json:"async,omitempty" mcp:"Queue the download and return a job ID right away"`
+	Timeouts *TimeoutParams `json:"timeouts,omitempty" mcp:"Timeouts replacing the configured ones for this download"`
+}
+
+type TimeoutParams struct {
+	Connect        string `json:"connect,omitempty" mcp:"Maximum time to establish a connection, such as 15s"`
+	ResponseHeader string `json:"response_header,omitempty" mcp:"Maximum time to wait for a server to start responding"`
+	Idle           string `json:"idle,omitempty" mcp:"Maximum time a download may go without receiving data"`
+	Total          string `json:"total,omitempty" mcp:"Maximum duration of the whole download, 0 for no limit"`
+}
+
+type MirrorStatusParams struct{}
+
+type AccountStatusParams struct{}
+
+type QueueAddParams struct {
+	Books []QueueBookParams `json:"books,omitempty" mcp:"Books to download, by MD5 hash"`
+	DOIs  []string          `json:"dois,omitempty" mcp:"DOIs of papers to download"`
+}
+
+type QueueBookParams struct {
+	BookHash string `json:"hash" mcp:"MD5 hash of the book to download"`
+	Title    string `json:"title" mcp:"Book title, used for filename"`
+	Format   string `json:"format" mcp:"Book format, for example pdf or epub"`
+}
+
+type QueueListParams struct {
+	State string `json:"state,omitempty" mcp:"Only list jobs in this state"`
+}
+
+type QueueJobParams struct {
+	ID string `json:"id" mcp:"ID of the job"`
+}
+
+type DownloadPapersParams struct {
+	DOIs         []string       `json:"dois,omitempty" mcp:"DOIs of the papers to download"`
+	Bibliography string         `json:"bibliography,omitempty" mcp:"BibTeX or RIS bibliography, or any text containing DOIs"`
+	Concurrency  int            `json:"concurrency,omitempty" mcp:"Number of papers to download at the same time"`
+	Timeouts     *TimeoutParams `json:"timeouts,omitempty" mcp:"Timeouts replacing the configured ones for every download"`
+}
+
+type DownloadStatusParams struct {
+	ID string `json:"id" mcp:"ID of the download job"`
+}
+
+type LibrarySearchParams struct {
+	Query string `json:"query,omitempty" mcp:"Words to look for in the title, authors, DOI or MD5 hash of the downloaded files"`
 }
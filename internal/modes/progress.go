@@ -0,0 +1,75 @@
+package modes
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+)
+
+const progressBarWidth = 30
+
+// progressBar draws download progress on a single terminal line.
+type progressBar struct {
+	out     io.Writer
+	started bool
+}
+
+// newProgressBar returns a bar drawing on stderr, or nil when stderr is not a
+// terminal, so that redirected output stays free of control characters.
+func newProgressBar() *progressBar {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progressBar{out: os.Stderr}
+}
+
+// Progress returns the callback to pass in anna.DownloadOptions, which is nil
+// when there is no bar to draw.
+func (p *progressBar) Progress() anna.ProgressFunc {
+	if p == nil {
+		return nil
+	}
+	return p.Update
+}
+
+// Update redraws the bar. It has the signature of anna.ProgressFunc.
+func (p *progressBar) Update(done, total int64) {
+	p.started = true
+	if total <= 0 {
+		fmt.Fprintf(p.out, "\r%s downloaded", formatBytes(done))
+		return
+	}
+
+	ratio := float64(done) / float64(total)
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Fprintf(p.out, "\r%3.0f%% [%s] %s / %s", ratio*100, bar, formatBytes(done), formatBytes(total))
+}
+
+// Finish moves the cursor past the bar once the download is over.
+func (p *progressBar) Finish() {
+	if p != nil && p.started {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// formatBytes renders a size with decimal units, as the site does.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
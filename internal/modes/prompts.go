@@ -0,0 +1,181 @@
+package modes
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iosifache/annas-mcp/internal/citations"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// defaultReviewSize is the number of papers the literature_review prompt
+// asks for when none is given.
+const defaultReviewSize = 10
+
+// serverPrompts returns the prompts of the MCP server, which walk the
+// assistant through the research workflows built on the tools.
+func serverPrompts() []*mcp.ServerPrompt {
+	return []*mcp.ServerPrompt{
+		{
+			Prompt: &mcp.Prompt{
+				Name:        "best_edition",
+				Title:       "Find the best edition of a book",
+				Description: "Search a book, compare its editions and files, and download the best one.",
+				Arguments: []*mcp.PromptArgument{
+					{Name: "title", Description: "Title of the book", Required: true},
+					{Name: "author", Description: "Author of the book"},
+					{Name: "edition", Description: "Edition wanted, e.g. '3rd' or '2019', instead of the latest one"},
+					{Name: "format", Description: "File format wanted, e.g. epub or pdf"},
+					{Name: "language", Description: "Language wanted, as a code, e.g. en"},
+				},
+			},
+			Handler: BestEditionPrompt,
+		},
+		{
+			Prompt: &mcp.Prompt{
+				Name:        "literature_review",
+				Title:       "Collect papers for a literature review",
+				Description: "Search the papers on a topic, pick the most relevant ones, and download them.",
+				Arguments: []*mcp.PromptArgument{
+					{Name: "topic", Description: "Topic of the review", Required: true},
+					{Name: "count", Description: fmt.Sprintf("Number of papers to collect (default %d)", defaultReviewSize)},
+					{Name: "since", Description: "Only consider papers published in or after this year"},
+				},
+			},
+			Handler: LiteratureReviewPrompt,
+		},
+		{
+			Prompt: &mcp.Prompt{
+				Name:        "citation_pdf",
+				Title:       "Get the PDF for a citation",
+				Description: "Find the paper a citation refers to, and download its PDF.",
+				Arguments: []*mcp.PromptArgument{
+					{Name: "citation", Description: "The citation, in any style, or a DOI", Required: true},
+				},
+			},
+			Handler: CitationPDFPrompt,
+		},
+	}
+}
+
+// promptArgument returns the trimmed value of a prompt argument, or an error
+// if a required one is empty.
+func promptArgument(params *mcp.GetPromptParams, name string, required bool) (string, error) {
+	value := strings.TrimSpace(params.Arguments[name])
+	if value == "" && required {
+		return "", fmt.Errorf("missing argument: %s", name)
+	}
+	return value, nil
+}
+
+// promptResult returns a prompt made of a single user message.
+func promptResult(description, text string) *mcp.GetPromptResult {
+	return &mcp.GetPromptResult{
+		Description: description,
+		Messages: []*mcp.PromptMessage{{
+			Role:    "user",
+			Content: &mcp.TextContent{Text: text},
+		}},
+	}
+}
+
+func BestEditionPrompt(ctx context.Context, ss *mcp.ServerSession, params *mcp.GetPromptParams) (*mcp.GetPromptResult, error) {
+	title, err := promptArgument(params, "title", true)
+	if err != nil {
+		return nil, err
+	}
+	author, _ := promptArgument(params, "author", false)
+	edition, _ := promptArgument(params, "edition", false)
+	format, _ := promptArgument(params, "format", false)
+	language, _ := promptArgument(params, "language", false)
+
+	book := fmt.Sprintf("%q", title)
+	term := title
+	if author != "" {
+		book += " by " + author
+		term += " " + author
+	}
+
+	var filters []string
+	if format != "" {
+		filters = append(filters, fmt.Sprintf("extension to [%q]", format))
+	}
+	if language != "" {
+		filters = append(filters, fmt.Sprintf("language to [%q]", language))
+	}
+	search := fmt.Sprintf("Search for it with the search tool, with %q as the term", term)
+	if len(filters) > 0 {
+		search += " and " + strings.Join(filters, " and ")
+	}
+	search += ". If nothing relevant comes up, search again with the title alone, with alternative titles, or without the filters."
+
+	wanted := "the latest edition"
+	if edition != "" {
+		wanted = "the " + edition + " edition"
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "Find the best edition of the book %s on Anna's Archive and download it.\n\n", book)
+	fmt.Fprintf(&text, "1. %s\n", search)
+	fmt.Fprintf(&text, "2. Keep the results that are this book, not summaries, study guides or other books with a similar title. Among them, prefer %s, then the requested format and language, then complete publisher files over scans and conversions. Compare the best candidates with the book_details tool: ISBNs, year, edition, publisher, size and other file versions.\n", wanted)
+	text.WriteString("3. Tell me which file you picked and why in a sentence or two, and name the runner-up.\n")
+	text.WriteString("4. Check with the library_search tool whether the file was already downloaded, and if so, give me its path instead of downloading it again. Otherwise, check the account_status tool, and warn me before using one of the last fast downloads of the day. Then download the file with the download tool, using the hash, title and format of the search result.\n")
+
+	return promptResult("Find and download the best edition of "+book, text.String()), nil
+}
+
+func LiteratureReviewPrompt(ctx context.Context, ss *mcp.ServerSession, params *mcp.GetPromptParams) (*mcp.GetPromptResult, error) {
+	topic, err := promptArgument(params, "topic", true)
+	if err != nil {
+		return nil, err
+	}
+	count := defaultReviewSize
+	if raw, _ := promptArgument(params, "count", false); raw != "" {
+		count, err = strconv.Atoi(raw)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("count must be a positive number, got: %s", raw)
+		}
+	}
+	since, _ := promptArgument(params, "since", false)
+	if since != "" {
+		if _, err := strconv.Atoi(since); err != nil {
+			return nil, fmt.Errorf("since must be a year, got: %s", since)
+		}
+	}
+
+	search := "Search journal articles with the search tool, setting content to journal"
+	if since != "" {
+		search += " and year_from to " + since
+	}
+	search += ". Run several searches, with different phrasings and with the key concepts of the topic, and look through more than the first page. Sort by newest once to find the recent work."
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "Collect papers for a literature review on %s.\n\n", topic)
+	fmt.Fprintf(&text, "1. %s\n", search)
+	fmt.Fprintf(&text, "2. Select the %d most relevant papers: reviews and seminal work along with the most significant recent findings. Skip duplicates and papers that only mention the topic in passing.\n", count)
+	text.WriteString("3. Confirm the DOI of each selected paper with the doi tool.\n")
+	text.WriteString("4. Check with the library_search tool which of them were already downloaded, and download the others all at once with the download_papers tool, giving their DOIs. If some cannot be found, look for another version of them before giving up.\n")
+	text.WriteString("5. Finish with a table of the papers: authors, year, title, journal, DOI, one line on what it brings to the review, and whether it was downloaded.\n")
+
+	return promptResult("Collect papers for a literature review on "+topic, text.String()), nil
+}
+
+func CitationPDFPrompt(ctx context.Context, ss *mcp.ServerSession, params *mcp.GetPromptParams) (*mcp.GetPromptResult, error) {
+	citation, err := promptArgument(params, "citation", true)
+	if err != nil {
+		return nil, err
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "Get the PDF of the paper this citation refers to:\n\n%s\n\n", citation)
+	if doi := citations.NormalizeDOI(citation); doi != "" {
+		fmt.Fprintf(&text, "1. Look the paper up by its DOI, %s, with the doi tool, and check that its title and authors match the citation.\n", doi)
+	} else {
+		text.WriteString("1. Search for the paper with the search tool, setting content to journal, with its title and first author as the term. Pick the result whose title, authors, year and journal match the citation, and ask me before going on if none matches closely. Then look it up by its DOI with the doi tool.\n")
+	}
+	text.WriteString("2. Check with the library_search tool whether it was already downloaded. If not, download it with the download_paper tool. Then attach the file, which is available as a resource under its file:// URI.\n")
+
+	return promptResult("Get the PDF for a citation", text.String()), nil
+}
@@ -0,0 +1,264 @@
+package modes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"go.uber.org/zap"
+)
+
+const (
+	bookResourcePrefix  = "anna://md5/"
+	paperResourcePrefix = "anna://doi/"
+
+	// maxResourceSize bounds the files read as resources, which are sent
+	// whole and base64 encoded in a single message.
+	maxResourceSize = 100 << 20
+)
+
+// documentMIMETypes are the types of the formats found on Anna's Archive,
+// which the system MIME tables often do not know.
+var documentMIMETypes = map[string]string{
+	".pdf":  "application/pdf",
+	".epub": "application/epub+zip",
+	".mobi": "application/x-mobipocket-ebook",
+	".azw3": "application/vnd.amazon.ebook",
+	".djvu": "image/vnd.djvu",
+	".fb2":  "application/x-fictionbook+xml",
+	".cbz":  "application/vnd.comicbook+zip",
+	".cbr":  "application/vnd.comicbook-rar",
+	".chm":  "application/vnd.ms-htmlhelp",
+	".txt":  "text/plain",
+}
+
+func fileMIMEType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if mimeType, ok := documentMIMETypes[ext]; ok {
+		return mimeType
+	}
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+func fileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// fileResourceLink points the client to a downloaded file, which it can read
+// as a resource to attach it to the conversation.
+func fileResourceLink(path string, size int64) *mcp.ResourceLink {
+	return &mcp.ResourceLink{
+		URI:      fileURI(path),
+		Name:     filepath.Base(path),
+		MIMEType: fileMIMEType(path),
+		Size:     &size,
+	}
+}
+
+// resourceTemplates returns the templates of the records that can be read by
+// their MD5 hash or DOI.
+func resourceTemplates() []*mcp.ServerResourceTemplate {
+	return []*mcp.ServerResourceTemplate{
+		{
+			ResourceTemplate: &mcp.ResourceTemplate{
+				Name:        "book",
+				Title:       "Book record",
+				URITemplate: bookResourcePrefix + "{hash}",
+				Description: "Full record of a book or any other file of Anna's Archive by its MD5 hash, as returned by the book_details tool.",
+				MIMEType:    "application/json",
+			},
+			Handler: bookResource,
+		},
+		{
+			ResourceTemplate: &mcp.ResourceTemplate{
+				Name:  "paper",
+				Title: "Paper record",
+				// The DOI may contain slashes, escaped or not
+				URITemplate: paperResourcePrefix + "{+doi}",
+				Description: "Record of a journal article by its DOI, as returned by the doi tool.",
+				MIMEType:    "application/json",
+			},
+			Handler: paperResource,
+		},
+	}
+}
+
+func bookResource(ctx context.Context, ss *mcp.ServerSession, params *mcp.ReadResourceParams) (*mcp.ReadResourceResult, error) {
+	hash := strings.TrimPrefix(params.URI, bookResourcePrefix)
+	if !anna.IsMD5(hash) {
+		return nil, mcp.ResourceNotFoundError(params.URI)
+	}
+
+	details, err := anna.GetBookDetails(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return jsonResource(params.URI, details)
+}
+
+func paperResource(ctx context.Context, ss *mcp.ServerSession, params *mcp.ReadResourceParams) (*mcp.ReadResourceResult, error) {
+	doi, err := url.PathUnescape(strings.TrimPrefix(params.URI, paperResourcePrefix))
+	if err != nil || doi == "" {
+		return nil, mcp.ResourceNotFoundError(params.URI)
+	}
+
+	paper, err := anna.LookupDOI(ctx, doi)
+	if errors.Is(err, anna.ErrPaperNotFound) {
+		return nil, mcp.ResourceNotFoundError(params.URI)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jsonResource(params.URI, paper)
+}
+
+func jsonResource(uri string, v any) (*mcp.ReadResourceResult, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{{
+		URI:      uri,
+		MIMEType: "application/json",
+		Text:     string(data),
+	}}}, nil
+}
+
+// fileResource reads a file of the download folder.
+func fileResource(path string) mcp.ResourceHandler {
+	return func(ctx context.Context, ss *mcp.ServerSession, params *mcp.ReadResourceParams) (*mcp.ReadResourceResult, error) {
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, mcp.ResourceNotFoundError(params.URI)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > maxResourceSize {
+			return nil, fmt.Errorf("%s is too large to be read as a resource (%d bytes, at most %d)", info.Name(), info.Size(), maxResourceSize)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		contents := &mcp.ResourceContents{URI: params.URI, MIMEType: fileMIMEType(path)}
+		if strings.HasPrefix(contents.MIMEType, "text/") {
+			contents.Text = string(data)
+		} else {
+			contents.Blob = data
+		}
+		return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{contents}}, nil
+	}
+}
+
+// folderResources publishes the files of the download folder as resources
+// of a server, and keeps them up to date as files are downloaded. Every change
+// notifies the clients that the list of resources changed.
+type folderResources struct {
+	server *mcp.Server
+
+	mu sync.Mutex
+	// files are the modification times of the published files, by URI
+	files map[string]time.Time
+}
+
+func newFolderResources(server *mcp.Server) *folderResources {
+	return &folderResources{server: server, files: make(map[string]time.Time)}
+}
+
+// sync publishes the files of the download folder of the settings in ctx
+// that are new or changed, and withdraws the ones that are gone. Partial
+// downloads, files that failed verification and hidden files are left out.
+func (f *folderResources) sync(ctx context.Context) {
+	l := logger.GetLogger()
+
+	env, err := env.FromContext(ctx)
+	if err != nil {
+		l.Warn("Failed to list downloaded files", zap.Error(err))
+		return
+	}
+
+	current := make(map[string]*mcp.ServerResource)
+	modified := make(map[string]time.Time)
+	if env.DownloadPath != "" {
+		entries, err := os.ReadDir(env.DownloadPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			l.Warn("Failed to list downloaded files", zap.String("path", env.DownloadPath), zap.Error(err))
+			return
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, anna.PartFileSuffix) || strings.HasSuffix(name, anna.CorruptFileSuffix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			path := filepath.Join(env.DownloadPath, name)
+			uri := fileURI(path)
+			current[uri] = &mcp.ServerResource{
+				Resource: &mcp.Resource{
+					URI:         uri,
+					Name:        name,
+					Description: "Downloaded file",
+					MIMEType:    fileMIMEType(path),
+					Size:        info.Size(),
+				},
+				Handler: fileResource(path),
+			}
+			modified[uri] = info.ModTime()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	added := make([]*mcp.ServerResource, 0)
+	for uri, resource := range current {
+		if published, ok := f.files[uri]; !ok || !published.Equal(modified[uri]) {
+			added = append(added, resource)
+		}
+	}
+	removed := make([]string, 0)
+	for uri := range f.files {
+		if _, ok := current[uri]; !ok {
+			removed = append(removed, uri)
+		}
+	}
+	f.files = modified
+
+	if len(added) > 0 {
+		f.server.AddResources(added...)
+	}
+	if len(removed) > 0 {
+		f.server.RemoveResources(removed...)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		l.Info("Downloaded files updated",
+			zap.String("path", env.DownloadPath),
+			zap.Int("added", len(added)),
+			zap.Int("removed", len(removed)),
+		)
+	}
+}
@@ -0,0 +1,418 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+	"github.com/iosifache/annas-mcp/internal/env"
+)
+
+const (
+	// lockTimeout is how long to wait for another process to release the
+	// queue file.
+	lockTimeout    = 10 * time.Second
+	lockRetryDelay = 20 * time.Millisecond
+	// staleLockAge is how old a lock has to be to be considered left behind
+	// by a process that died while holding it.
+	staleLockAge = 30 * time.Second
+)
+
+// ErrJobNotFound is returned for an ID that is not in the queue.
+var ErrJobNotFound = errors.New("job not found")
+
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateDone      State = "done"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+type Kind string
+
+const (
+	// KindBook downloads a file by its MD5 through the fast download API
+	KindBook Kind = "book"
+	// KindPaper downloads a paper by its DOI, falling back to SciDB
+	KindPaper Kind = "paper"
+)
+
+// Job is a single download in the queue.
+type Job struct {
+	ID     string `json:"id"`
+	Kind   Kind   `json:"kind"`
+	Hash   string `json:"hash,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Format string `json:"format,omitempty"`
+	DOI    string `json:"doi,omitempty"`
+	State  State  `json:"state"`
+	// Attempts counts the runs of the job, including the current one
+	Attempts int `json:"attempts"`
+	// Error is the reason of the last failure, kept while a retry is pending
+	Error string `json:"error,omitempty"`
+	// BytesDone and BytesTotal report the progress of a running job. The
+	// total is -1 when the server did not announce it.
+	BytesDone  int64                `json:"bytes_done,omitempty"`
+	BytesTotal int64                `json:"bytes_total,omitempty"`
+	Result     *anna.DownloadResult `json:"result,omitempty"`
+	CreatedAt  time.Time            `json:"created_at"`
+	UpdatedAt  time.Time            `json:"updated_at"`
+	// NextAttemptAt delays a failed job until its backoff is over
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	// Owner identifies the runner processing the job
+	Owner string `json:"owner,omitempty"`
+}
+
+// Target describes what the job downloads.
+func (j *Job) Target() string {
+	if j.Kind == KindPaper {
+		return "paper " + j.DOI
+	}
+	if j.Title == "" {
+		return "book " + j.Hash
+	}
+	return fmt.Sprintf("book %s (%s)", j.Hash, j.Title)
+}
+
+// sameTarget tells whether both jobs download the same file.
+func (j *Job) sameTarget(other *Job) bool {
+	if j.Kind != other.Kind {
+		return false
+	}
+	if j.Kind == KindPaper {
+		return strings.EqualFold(j.DOI, other.DOI)
+	}
+	return strings.EqualFold(j.Hash, other.Hash)
+}
+
+func (j *Job) active() bool {
+	return j.State == StateQueued || j.State == StateRunning
+}
+
+func (j *Job) validate() error {
+	switch j.Kind {
+	case KindBook:
+		if !anna.IsMD5(j.Hash) {
+			return fmt.Errorf("invalid MD5 hash: %s", j.Hash)
+		}
+	case KindPaper:
+		if j.DOI == "" {
+			return errors.New("missing DOI")
+		}
+	default:
+		return fmt.Errorf("unknown job kind %q", j.Kind)
+	}
+	return nil
+}
+
+func (j *Job) String() string {
+	s := fmt.Sprintf("ID: %s\nTarget: %s\nState: %s\nAttempts: %d", j.ID, j.Target(), j.State, j.Attempts)
+	if j.State == StateRunning && j.BytesDone > 0 {
+		s += fmt.Sprintf("\nDownloaded: %d bytes", j.BytesDone)
+		if j.BytesTotal > 0 {
+			s += fmt.Sprintf(" of %d (%.0f%%)", j.BytesTotal, float64(j.BytesDone)*100/float64(j.BytesTotal))
+		}
+	}
+	if j.Error != "" {
+		s += "\nError: " + j.Error
+	}
+	if j.State == StateQueued && time.Now().Before(j.NextAttemptAt) {
+		s += "\nNext attempt: " + j.NextAttemptAt.Format(time.RFC3339)
+	}
+	if j.Result != nil {
+		s += "\n" + j.Result.String()
+	}
+	return s
+}
+
+// JobList is the content of the queue file.
+type JobList struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+// Store keeps the queue in a JSON file. Every change locks the file and
+// reads it again, so that several processes, such as the MCP server and the
+// CLI, can share the same queue.
+type Store struct {
+	path string
+}
+
+// Open returns the queue of the profile selected in e.
+func Open(e *env.Env) (*Store, error) {
+	path, err := e.StatePath("queue", ".json")
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(path), nil
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// List returns every job, in the order they were added.
+func (s *Store) List() ([]*Job, error) {
+	return s.load()
+}
+
+func (s *Store) Get(id string) (*Job, error) {
+	jobs, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	job := find(jobs, id)
+	if job == nil {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return job, nil
+}
+
+// Add queues the given jobs and returns them with their IDs. A job for a
+// file that is already queued or running is not added again, and the
+// existing job is returned instead.
+func (s *Store) Add(jobs ...*Job) ([]*Job, error) {
+	for _, job := range jobs {
+		if err := job.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	added := make([]*Job, 0, len(jobs))
+	err := s.update(func(queued []*Job) ([]*Job, error) {
+		now := time.Now().UTC()
+		for _, job := range jobs {
+			if existing := findTarget(queued, job); existing != nil {
+				added = append(added, existing)
+				continue
+			}
+
+			id, err := newID()
+			if err != nil {
+				return nil, err
+			}
+			added = append(added, &Job{
+				ID:        id,
+				Kind:      job.Kind,
+				Hash:      strings.ToLower(job.Hash),
+				Title:     job.Title,
+				Format:    job.Format,
+				DOI:       job.DOI,
+				State:     StateQueued,
+				CreatedAt: now,
+				UpdatedAt: now,
+			})
+			queued = append(queued, added[len(added)-1])
+		}
+		return queued, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// Cancel stops a queued or running job. A running job is stopped by its
+// runner, which notices the change within a few seconds.
+func (s *Store) Cancel(id string) (*Job, error) {
+	return s.change(id, func(job *Job) error {
+		if !job.active() {
+			return fmt.Errorf("job %s is already %s", id, job.State)
+		}
+		job.State = StateCancelled
+		job.Owner = ""
+		return nil
+	})
+}
+
+// Retry queues a failed or cancelled job again, with a fresh set of
+// attempts.
+func (s *Store) Retry(id string) (*Job, error) {
+	return s.change(id, func(job *Job) error {
+		if job.State != StateFailed && job.State != StateCancelled {
+			return fmt.Errorf("job %s is %s, only failed and cancelled jobs can be retried", id, job.State)
+		}
+		job.State = StateQueued
+		job.Attempts = 0
+		job.Error = ""
+		job.BytesDone = 0
+		job.BytesTotal = 0
+		job.NextAttemptAt = time.Time{}
+		return nil
+	})
+}
+
+// Clear removes the jobs that are done or cancelled, and returns how many
+// there were.
+func (s *Store) Clear() (int, error) {
+	removed := 0
+	err := s.update(func(jobs []*Job) ([]*Job, error) {
+		kept := jobs[:0]
+		for _, job := range jobs {
+			if job.State == StateDone || job.State == StateCancelled {
+				removed++
+				continue
+			}
+			kept = append(kept, job)
+		}
+		return kept, nil
+	})
+	return removed, err
+}
+
+// change applies fn to a single job.
+func (s *Store) change(id string, fn func(job *Job) error) (*Job, error) {
+	var changed *Job
+	err := s.update(func(jobs []*Job) ([]*Job, error) {
+		job := find(jobs, id)
+		if job == nil {
+			return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+		}
+		if err := fn(job); err != nil {
+			return nil, err
+		}
+		job.UpdatedAt = time.Now().UTC()
+		changed = job
+		return jobs, nil
+	})
+	return changed, err
+}
+
+// update reads the queue, applies fn and writes the result back, while
+// holding the lock.
+func (s *Store) update(fn func(jobs []*Job) ([]*Job, error)) error {
+	return s.modify(func(jobs []*Job) ([]*Job, bool, error) {
+		jobs, err := fn(jobs)
+		return jobs, true, err
+	})
+}
+
+// modify is like update, but only writes the queue back when fn reports a
+// change, so that the frequent checks of the runners leave the file alone.
+func (s *Store) modify(fn func(jobs []*Job) ([]*Job, bool, error)) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	jobs, err := s.load()
+	if err != nil {
+		return err
+	}
+	jobs, changed, err := fn(jobs)
+	if err != nil || !changed {
+		return err
+	}
+	return s.save(jobs)
+}
+
+func (s *Store) load() ([]*Job, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue: %w", err)
+	}
+
+	var list JobList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse queue %s: %w", s.path, err)
+	}
+	return list.Jobs, nil
+}
+
+// save replaces the queue file at once, so that readers that do not take
+// the lock never see it half written.
+func (s *Store) save(jobs []*Job) error {
+	data, err := json.MarshalIndent(&JobList{Jobs: jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write queue: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write queue: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write queue: %w", err)
+	}
+	return nil
+}
+
+// lock takes the lock file next to the queue, waiting for other processes
+// to release it.
+func (s *Store) lock() (func(), error) {
+	lockPath := s.path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("failed to lock queue: %w", err)
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for the queue lock %s", lockPath)
+		}
+		time.Sleep(lockRetryDelay)
+	}
+}
+
+func find(jobs []*Job, id string) *Job {
+	for _, job := range jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func findTarget(jobs []*Job, target *Job) *Job {
+	for _, job := range jobs {
+		if job.active() && job.sameTarget(target) {
+			return job
+		}
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
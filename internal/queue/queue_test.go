@@ -0,0 +1,473 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testHash  = "0123456789abcdef0123456789abcdef"
+	testHash2 = "fedcba9876543210fedcba9876543210"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	return NewStore(filepath.Join(t.TempDir(), "queue.json"))
+}
+
+func addJobs(t *testing.T, s *Store, jobs ...*Job) []*Job {
+	t.Helper()
+	added, err := s.Add(jobs...)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	return added
+}
+
+// setJob changes a job in place, bypassing the rules of the store, to set up
+// a test.
+func setJob(t *testing.T, s *Store, id string, fn func(job *Job)) {
+	t.Helper()
+	err := s.update(func(jobs []*Job) ([]*Job, error) {
+		fn(find(jobs, id))
+		return jobs, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getJob(t *testing.T, s *Store, id string) *Job {
+	t.Helper()
+	job, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get(%s) error = %v", id, err)
+	}
+	return job
+}
+
+func TestAdd(t *testing.T) {
+	s := newTestStore(t)
+
+	added := addJobs(t, s,
+		&Job{Kind: KindBook, Hash: testHash, Title: "Book"},
+		&Job{Kind: KindPaper, DOI: "10.1000/a"},
+	)
+	if len(added) != 2 || added[0].ID == "" || added[0].ID == added[1].ID {
+		t.Fatalf("Add() = %+v, want two jobs with distinct IDs", added)
+	}
+	for _, job := range added {
+		if job.State != StateQueued {
+			t.Errorf("job %s is %s, want %s", job.ID, job.State, StateQueued)
+		}
+	}
+
+	// Jobs for files already queued are not added again
+	again := addJobs(t, s,
+		&Job{Kind: KindBook, Hash: "0123456789ABCDEF0123456789ABCDEF"},
+		&Job{Kind: KindPaper, DOI: "10.1000/A"},
+	)
+	if again[0].ID != added[0].ID || again[1].ID != added[1].ID {
+		t.Errorf("Add() of queued files = %s, %s, want the existing jobs %s, %s", again[0].ID, again[1].ID, added[0].ID, added[1].ID)
+	}
+
+	// Unless the earlier job is over
+	if _, err := s.Cancel(added[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if readded := addJobs(t, s, &Job{Kind: KindBook, Hash: testHash}); readded[0].ID == added[0].ID {
+		t.Error("Add() returned a cancelled job instead of queuing the file again")
+	}
+
+	for _, invalid := range []*Job{
+		{Kind: KindBook, Hash: "not a hash"},
+		{Kind: KindPaper},
+		{Kind: "video"},
+	} {
+		if _, err := s.Add(invalid); err == nil {
+			t.Errorf("Add(%+v) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   State
+		change  func(s *Store, id string) (*Job, error)
+		want    State
+		wantErr bool
+	}{
+		{name: "cancel queued", state: StateQueued, change: (*Store).Cancel, want: StateCancelled},
+		{name: "cancel running", state: StateRunning, change: (*Store).Cancel, want: StateCancelled},
+		{name: "cancel done", state: StateDone, change: (*Store).Cancel, want: StateDone, wantErr: true},
+		{name: "cancel cancelled", state: StateCancelled, change: (*Store).Cancel, want: StateCancelled, wantErr: true},
+		{name: "retry failed", state: StateFailed, change: (*Store).Retry, want: StateQueued},
+		{name: "retry cancelled", state: StateCancelled, change: (*Store).Retry, want: StateQueued},
+		{name: "retry running", state: StateRunning, change: (*Store).Retry, want: StateRunning, wantErr: true},
+		{name: "retry done", state: StateDone, change: (*Store).Retry, want: StateDone, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			job := addJobs(t, s, &Job{Kind: KindBook, Hash: testHash})[0]
+			setJob(t, s, job.ID, func(j *Job) {
+				j.State = tt.state
+				j.Owner = "runner"
+				j.Attempts = 3
+				j.Error = "boom"
+				j.NextAttemptAt = time.Now().Add(time.Hour)
+			})
+
+			_, err := tt.change(s, job.ID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got := getJob(t, s, job.ID)
+			if got.State != tt.want {
+				t.Errorf("state = %s, want %s", got.State, tt.want)
+			}
+			if tt.want == StateCancelled && !tt.wantErr && got.Owner != "" {
+				t.Errorf("cancelled job still owned by %q", got.Owner)
+			}
+			if tt.want == StateQueued && !tt.wantErr && (got.Attempts != 0 || got.Error != "" || !got.NextAttemptAt.IsZero()) {
+				t.Errorf("retried job = %+v, want a fresh set of attempts", got)
+			}
+		})
+	}
+
+	t.Run("unknown job", func(t *testing.T) {
+		s := newTestStore(t)
+		if _, err := s.Cancel("missing"); !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("Cancel() error = %v, want %v", err, ErrJobNotFound)
+		}
+	})
+}
+
+func TestClear(t *testing.T) {
+	s := newTestStore(t)
+	states := []State{StateQueued, StateRunning, StateDone, StateFailed, StateCancelled}
+	ids := make(map[State]string)
+	for i, state := range states {
+		job := addJobs(t, s, &Job{Kind: KindPaper, DOI: fmt.Sprintf("10.1000/%d", i)})[0]
+		setJob(t, s, job.ID, func(j *Job) { j.State = state })
+		ids[state] = job.ID
+	}
+
+	removed, err := s.Clear()
+	if err != nil || removed != 2 {
+		t.Fatalf("Clear() = %d, %v, want 2 jobs removed", removed, err)
+	}
+	for _, state := range states {
+		_, err := s.Get(ids[state])
+		if gone := errors.Is(err, ErrJobNotFound); gone != (state == StateDone || state == StateCancelled) {
+			t.Errorf("%s job removed = %v", state, gone)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name string
+		// setup changes the single queued job
+		setup       func(j *Job)
+		now         time.Time
+		wantClaimed bool
+		wantPending bool
+		wantAttempt int
+	}{
+		{
+			name:        "ready job",
+			setup:       func(j *Job) {},
+			now:         now,
+			wantClaimed: true,
+			wantAttempt: 1,
+		},
+		{
+			name: "backoff not over",
+			setup: func(j *Job) {
+				j.Attempts = 1
+				j.NextAttemptAt = now.Add(time.Minute)
+			},
+			now:         now,
+			wantPending: true,
+			wantAttempt: 1,
+		},
+		{
+			name: "backoff over",
+			setup: func(j *Job) {
+				j.Attempts = 1
+				j.NextAttemptAt = now.Add(time.Minute)
+			},
+			now:         now.Add(time.Minute),
+			wantClaimed: true,
+			wantAttempt: 2,
+		},
+		{
+			name: "running with heartbeats",
+			setup: func(j *Job) {
+				j.State = StateRunning
+				j.Owner = "other"
+				j.Attempts = 1
+				j.UpdatedAt = now
+			},
+			now:         now.Add(staleJobAge),
+			wantAttempt: 1,
+		},
+		{
+			name: "running without heartbeats",
+			setup: func(j *Job) {
+				j.State = StateRunning
+				j.Owner = "other"
+				j.Attempts = 1
+				j.UpdatedAt = now
+			},
+			now:         now.Add(staleJobAge + time.Second),
+			wantClaimed: true,
+			// The abandoned run does not count as an attempt
+			wantAttempt: 1,
+		},
+		{
+			name:        "failed",
+			setup:       func(j *Job) { j.State = StateFailed },
+			now:         now,
+			wantAttempt: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			job := addJobs(t, s, &Job{Kind: KindBook, Hash: testHash})[0]
+			setJob(t, s, job.ID, tt.setup)
+
+			claimed, pending, err := s.claim("me", tt.now)
+			if err != nil {
+				t.Fatalf("claim() error = %v", err)
+			}
+			if (claimed != nil) != tt.wantClaimed || pending != tt.wantPending {
+				t.Fatalf("claim() = %v, pending %v, want claimed %v, pending %v", claimed, pending, tt.wantClaimed, tt.wantPending)
+			}
+
+			got := getJob(t, s, job.ID)
+			if tt.wantClaimed && (got.State != StateRunning || got.Owner != "me") {
+				t.Errorf("claimed job is %s and owned by %q", got.State, got.Owner)
+			}
+			if got.Attempts != tt.wantAttempt {
+				t.Errorf("attempts = %d, want %d", got.Attempts, tt.wantAttempt)
+			}
+		})
+	}
+}
+
+func TestClaimConcurrent(t *testing.T) {
+	s := newTestStore(t)
+	for i := 0; i < 20; i++ {
+		addJobs(t, s, &Job{Kind: KindPaper, DOI: fmt.Sprintf("10.1000/%d", i)})
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[string]string)
+	var wg sync.WaitGroup
+	for w := 0; w < 5; w++ {
+		owner := fmt.Sprintf("runner-%d", w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, _, err := s.claim(owner, time.Now().UTC())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				if previous, ok := claimed[job.ID]; ok {
+					t.Errorf("job %s claimed by both %s and %s", job.ID, previous, owner)
+				}
+				claimed[job.ID] = owner
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != 20 {
+		t.Errorf("%d jobs claimed, want 20", len(claimed))
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	s := newTestStore(t)
+	job := addJobs(t, s, &Job{Kind: KindBook, Hash: testHash})[0]
+	start := time.Now().UTC()
+	if _, _, err := s.claim("me", start); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := s.heartbeat(job.ID, "me", 100, 1000)
+	if err != nil || !active {
+		t.Fatalf("heartbeat() = %v, %v, want the job active", active, err)
+	}
+	if got := getJob(t, s, job.ID); got.BytesDone != 100 || got.BytesTotal != 1000 {
+		t.Errorf("progress = %d of %d, want 100 of 1000", got.BytesDone, got.BytesTotal)
+	}
+
+	// A runner that stopped sending heartbeats loses the job to another one,
+	// and its next heartbeat tells it to stop
+	setJob(t, s, job.ID, func(j *Job) { j.UpdatedAt = start.Add(-staleJobAge - time.Second) })
+	if reclaimed, _, err := s.claim("other", start); err != nil || reclaimed == nil {
+		t.Fatalf("claim() of the abandoned job = %v, %v", reclaimed, err)
+	}
+	if active, err := s.heartbeat(job.ID, "me", 200, 1000); err != nil || active {
+		t.Errorf("heartbeat() of the former owner = %v, %v, want the job inactive", active, err)
+	}
+	if got := getJob(t, s, job.ID); got.Owner != "other" || got.BytesDone != 0 {
+		t.Errorf("former owner changed the job: %+v", got)
+	}
+
+	// As does a cancellation
+	if _, err := s.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := s.heartbeat(job.ID, "other", 10, 1000); err != nil || active {
+		t.Errorf("heartbeat() of a cancelled job = %v, %v, want the job inactive", active, err)
+	}
+	if updated, err := s.finish(job.ID, "other", func(j *Job) { j.State = StateDone }); err != nil || updated != nil {
+		t.Errorf("finish() of a cancelled job = %v, %v, want nothing finished", updated, err)
+	}
+	if got := getJob(t, s, job.ID); got.State != StateCancelled {
+		t.Errorf("cancelled job is %s after finish", got.State)
+	}
+}
+
+func TestIdleTicksLeaveTheFileAlone(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now().UTC()
+
+	// Without a queue file, nothing is created
+	if job, _, err := s.claim("me", now); err != nil || job != nil {
+		t.Fatalf("claim() on an empty queue = %v, %v", job, err)
+	}
+	if _, err := os.Stat(s.path); !os.IsNotExist(err) {
+		t.Fatalf("claim() on an empty queue created the file: %v", err)
+	}
+
+	done := addJobs(t, s, &Job{Kind: KindBook, Hash: testHash})[0]
+	setJob(t, s, done.ID, func(j *Job) { j.State = StateDone })
+	waiting := addJobs(t, s, &Job{Kind: KindBook, Hash: testHash2})[0]
+	setJob(t, s, waiting.ID, func(j *Job) { j.NextAttemptAt = now.Add(time.Hour) })
+	running := addJobs(t, s, &Job{Kind: KindPaper, DOI: "10.1000/a"})[0]
+	setJob(t, s, running.ID, func(j *Job) {
+		j.State = StateRunning
+		j.Owner = "me"
+		j.BytesDone = 10
+		j.BytesTotal = 100
+		j.UpdatedAt = time.Now().UTC()
+	})
+
+	before, err := os.Stat(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		job, pending, err := s.claim("me", now)
+		if err != nil || job != nil || !pending {
+			t.Fatalf("idle claim() = %v, pending %v, %v", job, pending, err)
+		}
+	}
+	// A heartbeat without progress since the last one does not need saving
+	if active, err := s.heartbeat(running.ID, "me", 10, 100); err != nil || !active {
+		t.Fatalf("heartbeat() = %v, %v", active, err)
+	}
+
+	after, err := os.Stat(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) || !after.ModTime().Equal(before.ModTime()) {
+		t.Error("idle ticks rewrote the queue file")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, RetryBackoff},
+		{2, 2 * RetryBackoff},
+		{3, 4 * RetryBackoff},
+		{10, MaxRetryBackoff},
+		{100, MaxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	h := newHostLimiter(2)
+	ctx := context.Background()
+
+	release1, err := h.acquire(ctx, "a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := h.acquire(ctx, "a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other hosts have slots of their own
+	releaseB, err := h.acquire(ctx, "b.example")
+	if err != nil {
+		t.Fatalf("acquire() of another host error = %v", err)
+	}
+	releaseB()
+
+	// A third transfer from the same host waits for a slot
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := h.acquire(timeoutCtx, "a.example"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire() beyond the limit error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, err := h.acquire(ctx, "a.example")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire() did not wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release1()
+	select {
+	case release3 := <-acquired:
+		release3()
+	case <-time.After(time.Second):
+		t.Fatal("acquire() did not get the released slot")
+	}
+	release2()
+}
@@ -0,0 +1,450 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iosifache/annas-mcp/internal/anna"
+	"github.com/iosifache/annas-mcp/internal/env"
+	"github.com/iosifache/annas-mcp/internal/library"
+	"github.com/iosifache/annas-mcp/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultWorkers     = 3
+	DefaultPerHost     = 2
+	DefaultMaxAttempts = 3
+	// RetryBackoff is the delay before the first retry of a failed job, and
+	// doubles with every further attempt up to MaxRetryBackoff.
+	RetryBackoff    = 30 * time.Second
+	MaxRetryBackoff = 10 * time.Minute
+
+	// pollInterval is how often idle workers look for new jobs.
+	pollInterval = time.Second
+	// heartbeatInterval is how often running jobs save their progress and
+	// check whether they were cancelled.
+	heartbeatInterval = 2 * time.Second
+	// staleJobAge is how long a running job may go without a heartbeat
+	// before it is considered abandoned by a runner that died, and queued
+	// again.
+	staleJobAge = 30 * time.Second
+)
+
+// errJobCancelled stops a job cancelled through the store.
+var errJobCancelled = errors.New("job cancelled")
+
+// permanentError marks failures that retrying cannot fix, such as missing
+// settings.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isPermanent tells whether a job that failed with err should not be retried.
+// Errors answered by the fast download API, such as an invalid key or an
+// exhausted quota, do not go away within the backoff.
+func isPermanent(err error) bool {
+	var p *permanentError
+	if errors.As(err, &p) {
+		return true
+	}
+	var apiErr *anna.FastDownloadError
+	if errors.As(err, &apiErr) && apiErr.StatusCode < http.StatusInternalServerError {
+		return true
+	}
+	return errors.Is(err, anna.ErrPaperNotFound)
+}
+
+// Options tune a Runner. A nil *Options uses the defaults.
+type Options struct {
+	// Workers is the number of jobs run at the same time
+	Workers int
+	// PerHost is the number of files transferred at the same time from a
+	// single host
+	PerHost int
+	// MaxAttempts is the number of runs of a job before it is failed
+	MaxAttempts int
+	// ExitWhenIdle stops Run once no job is left queued, instead of waiting
+	// for new ones
+	ExitWhenIdle bool
+	// OnUpdate, if set, is called whenever a job is done, failed, or queued
+	// again for a retry. It is called from the workers, concurrently.
+	OnUpdate func(job *Job)
+}
+
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.PerHost <= 0 {
+		opts.PerHost = DefaultPerHost
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	return opts
+}
+
+// Runner downloads the jobs of a queue with a pool of workers.
+type Runner struct {
+	store *Store
+	env   *env.Env
+	opts  Options
+	hosts *hostLimiter
+	// id marks the jobs taken by this runner, so that several processes can
+	// work on the same queue
+	id string
+}
+
+// NewRunner returns a runner downloading with the settings of e, which are
+// resolved once for all jobs.
+func NewRunner(store *Store, e *env.Env, opts *Options) *Runner {
+	o := opts.withDefaults()
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &Runner{
+		store: store,
+		env:   e,
+		opts:  o,
+		hosts: newHostLimiter(o.PerHost),
+		id:    hex.EncodeToString(id),
+	}
+}
+
+// Run processes jobs until ctx is cancelled or, with ExitWhenIdle, until the
+// queue is empty. Cancelling ctx suspends the running jobs: they are queued
+// again and keep their partial files, so that the next run resumes them.
+func (r *Runner) Run(ctx context.Context) error {
+	l := logger.GetLogger()
+	l.Info("Download queue runner started",
+		zap.Int("workers", r.opts.Workers),
+		zap.Int("perHost", r.opts.PerHost),
+	)
+
+	// The downloads use the same settings as the runner, which may be the
+	// ones of an MCP server user rather than the selected profile
+	ctx = env.WithEnv(ctx, r.env)
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+	wg.Wait()
+
+	l.Info("Download queue runner stopped")
+	return ctx.Err()
+}
+
+func (r *Runner) work(ctx context.Context) {
+	l := logger.GetLogger()
+
+	for ctx.Err() == nil {
+		job, pending, err := r.store.claim(r.id, time.Now().UTC())
+		if err != nil {
+			l.Error("Failed to take a job from the queue", zap.Error(err))
+		}
+		if job != nil {
+			r.process(ctx, job)
+			continue
+		}
+		if err == nil && !pending && r.opts.ExitWhenIdle {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// process runs a single job and records its outcome.
+func (r *Runner) process(ctx context.Context, job *Job) {
+	l := logger.GetLogger()
+	l.Info("Job started",
+		zap.String("id", job.ID),
+		zap.String("target", job.Target()),
+		zap.Int("attempt", job.Attempts),
+	)
+
+	// The job outlives ctx only to be suspended rather than cancelled, which
+	// keeps its partial file
+	jobCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	defer cancel(nil)
+	stop := context.AfterFunc(ctx, func() { cancel(anna.ErrSuspended) })
+	defer stop()
+
+	var done, total atomic.Int64
+	total.Store(-1)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	finished := make(chan struct{})
+	go func() {
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-heartbeat.C:
+				active, err := r.store.heartbeat(job.ID, r.id, done.Load(), total.Load())
+				if err != nil {
+					l.Warn("Failed to save job progress", zap.String("id", job.ID), zap.Error(err))
+				} else if !active {
+					cancel(errJobCancelled)
+				}
+			}
+		}
+	}()
+
+	result, err := r.download(jobCtx, job, &anna.DownloadOptions{
+		Progress: func(d, t int64) {
+			done.Store(d)
+			total.Store(t)
+		},
+		HostLimit: r.hosts.acquire,
+	})
+	close(finished)
+	if err == nil {
+		library.Record(jobCtx, result)
+	}
+
+	updated, saveErr := r.store.finish(job.ID, r.id, func(j *Job) {
+		now := time.Now().UTC()
+		j.Owner = ""
+		switch {
+		case err == nil:
+			j.State = StateDone
+			j.Error = ""
+			j.Result = result
+		case ctx.Err() != nil:
+			// Suspended jobs do not count as an attempt
+			j.State = StateQueued
+			j.Attempts--
+		case isPermanent(err) || j.Attempts >= r.opts.MaxAttempts:
+			j.State = StateFailed
+			j.Error = err.Error()
+		default:
+			j.State = StateQueued
+			j.Error = err.Error()
+			j.NextAttemptAt = now.Add(backoff(j.Attempts))
+		}
+	})
+	if saveErr != nil {
+		l.Error("Failed to save job outcome", zap.String("id", job.ID), zap.Error(saveErr))
+		return
+	}
+	if updated == nil {
+		l.Info("Job cancelled", zap.String("id", job.ID))
+		return
+	}
+
+	l.Info("Job finished",
+		zap.String("id", job.ID),
+		zap.String("state", string(updated.State)),
+		zap.Int("attempts", updated.Attempts),
+		zap.Error(err),
+	)
+	if r.opts.OnUpdate != nil && ctx.Err() == nil {
+		r.opts.OnUpdate(updated)
+	}
+}
+
+func (r *Runner) download(ctx context.Context, job *Job, opts *anna.DownloadOptions) (*anna.DownloadResult, error) {
+	switch job.Kind {
+	case KindBook:
+		if err := r.env.RequireFastDownload(); err != nil {
+			return nil, permanent(err)
+		}
+		book := &anna.Book{
+			Hash:   job.Hash,
+			Title:  job.Title,
+			Format: job.Format,
+		}
+		return book.Download(ctx, r.env.SecretKey, r.env.DownloadPath, opts)
+	case KindPaper:
+		if err := r.env.RequirePaperDownload(); err != nil {
+			return nil, permanent(err)
+		}
+		return anna.DownloadPaper(ctx, job.DOI, r.env.OptionalSecretKey(), r.env.DownloadPath, opts)
+	default:
+		return nil, permanent(fmt.Errorf("unknown job kind %q", job.Kind))
+	}
+}
+
+// backoff returns the delay before the attempt following the given one.
+func backoff(attempts int) time.Duration {
+	delay := RetryBackoff
+	for i := 1; i < attempts && delay < MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxRetryBackoff)
+}
+
+// claim marks the first job that is ready to run as taken by owner, and
+// returns it. pending tells whether jobs are still waiting, e.g. for their
+// backoff to end. Running jobs whose runner stopped sending heartbeats are
+// queued again on the way.
+func (s *Store) claim(owner string, now time.Time) (job *Job, pending bool, err error) {
+	// Most polls find nothing to do, which can be told without taking the
+	// lock, as the queue file is replaced at once
+	jobs, err := s.load()
+	if err != nil {
+		return nil, false, err
+	}
+	if ready, pending := readiness(jobs, now); !ready {
+		return nil, pending, nil
+	}
+
+	err = s.modify(func(jobs []*Job) ([]*Job, bool, error) {
+		changed := false
+		for _, j := range jobs {
+			if stale(j, now) {
+				j.State = StateQueued
+				j.Owner = ""
+				j.Attempts--
+				changed = true
+			}
+		}
+		for _, j := range jobs {
+			if j.State != StateQueued {
+				continue
+			}
+			if job == nil && !now.Before(j.NextAttemptAt) {
+				j.State = StateRunning
+				j.Owner = owner
+				j.Attempts++
+				j.BytesDone = 0
+				j.BytesTotal = 0
+				j.UpdatedAt = now
+				job = j
+				changed = true
+				continue
+			}
+			pending = true
+		}
+		return jobs, changed, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return job, pending, nil
+}
+
+// readiness tells whether claim has anything to do with jobs, that is a job
+// ready to run or an abandoned one to queue again, and whether queued jobs
+// are waiting for their backoff to end.
+func readiness(jobs []*Job, now time.Time) (ready, pending bool) {
+	for _, j := range jobs {
+		switch {
+		case stale(j, now):
+			ready = true
+		case j.State != StateQueued:
+		case now.Before(j.NextAttemptAt):
+			pending = true
+		default:
+			ready = true
+		}
+	}
+	return ready, pending
+}
+
+// stale tells whether j is running without heartbeats from its runner.
+func stale(j *Job, now time.Time) bool {
+	return j.State == StateRunning && now.Sub(j.UpdatedAt) > staleJobAge
+}
+
+// heartbeat saves the progress of a running job. It returns false when the
+// job is no longer run by owner, because it was cancelled or removed. A
+// progress that did not change is only saved every few heartbeats, to show
+// that the job is still alive.
+func (s *Store) heartbeat(id, owner string, done, total int64) (bool, error) {
+	active := false
+	err := s.modify(func(jobs []*Job) ([]*Job, bool, error) {
+		job := find(jobs, id)
+		if job == nil || job.State != StateRunning || job.Owner != owner {
+			return jobs, false, nil
+		}
+		active = true
+
+		now := time.Now().UTC()
+		if job.BytesDone == done && job.BytesTotal == total && now.Sub(job.UpdatedAt) < staleJobAge/3 {
+			return jobs, false, nil
+		}
+		job.BytesDone = done
+		job.BytesTotal = total
+		job.UpdatedAt = now
+		return jobs, true, nil
+	})
+	return active, err
+}
+
+// finish applies fn to a job run by owner, and returns the updated job. It
+// returns nil when the job was cancelled or removed in the meantime.
+func (s *Store) finish(id, owner string, fn func(job *Job)) (*Job, error) {
+	var finished *Job
+	err := s.modify(func(jobs []*Job) ([]*Job, bool, error) {
+		job := find(jobs, id)
+		if job == nil || job.State != StateRunning || job.Owner != owner {
+			return jobs, false, nil
+		}
+		fn(job)
+		job.UpdatedAt = time.Now().UTC()
+		finished = job
+		return jobs, true, nil
+	})
+	return finished, err
+}
+
+// hostLimiter bounds the number of transfers from each host. It has the
+// signature of anna.HostLimitFunc.
+type hostLimiter struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+func (h *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	h.mu.Lock()
+	slot, ok := h.slots[host]
+	if !ok {
+		slot = make(chan struct{}, h.limit)
+		h.slots[host] = slot
+	}
+	h.mu.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}